@@ -0,0 +1,406 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// payload is what the host shares: a regular file, a directory that is
+// archived on the fly every time it is read, or a secret held in memory.
+type payload struct {
+	path    string
+	name    string
+	format  string
+	size    int64  // the file's size, or the total size of the files in the directory
+	version string // changes whenever the plaintext may have, see scanDir
+	data    []byte // the secret, if it doesn't come from a file
+}
+
+func newPayload(filePath string, compress bool) (*payload, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	p := &payload{
+		path: filePath,
+		name: filepath.Base(filePath),
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		p.format = wire.FormatFile
+		p.size = info.Size()
+		p.version = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+	case info.IsDir():
+		p.format = wire.FormatTar
+		if compress {
+			p.format = wire.FormatTarZstd
+		}
+		if p.size, p.version, err = scanDir(filePath); err != nil {
+			return nil, fmt.Errorf("failed to read directory: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%s is neither a regular file nor a directory", filePath)
+	}
+
+	return p, nil
+}
+
+func (p *payload) isDir() bool {
+	return p.format != wire.FormatFile
+}
+
+// open returns the plaintext of the payload. Directories are archived
+// deterministically, so every read yields the same bytes for as long as
+// the files in it don't change.
+func (p *payload) open() (io.ReadCloser, error) {
+	if p.data != nil {
+		return io.NopCloser(bytes.NewReader(p.data)), nil
+	}
+	if !p.isDir() {
+		return os.Open(p.path)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, p.path, p.format))
+	}()
+	return pr, nil
+}
+
+// archivable reports whether the directory entry goes into the archive.
+// Anything but directories, regular files and symlinks is left out.
+func archivable(mode fs.FileMode) bool {
+	return mode.IsDir() || mode.IsRegular() || mode&fs.ModeSymlink != 0
+}
+
+// scanDir adds up the size of the files below root and warns about the
+// entries that won't be shared. The version it returns hashes the name,
+// mode, size, modification time and link target of every entry, so it
+// changes along with the archive.
+func scanDir(root string) (int64, string, error) {
+	dir, err := os.OpenRoot(root)
+	if err != nil {
+		return 0, "", err
+	}
+	defer dir.Close()
+
+	var size int64
+	version := sha256.New()
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		var target string
+		switch {
+		case !archivable(info.Mode()):
+			log.Printf("Warning: Skipping %s, only files, directories and symlinks are shared\n", path)
+			return nil
+		case info.Mode()&fs.ModeSymlink != 0:
+			if target, err = shareableLink(dir, rel); err != nil {
+				log.Printf("Warning: Skipping %s, the client would refuse it: %v\n", path, err)
+				return nil
+			}
+		case info.Mode().IsRegular():
+			size += info.Size()
+		}
+
+		fmt.Fprintf(version, "%q %v %d %d %q\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano(), target)
+		return nil
+	})
+
+	return size, hex.EncodeToString(version.Sum(nil)), err
+}
+
+// shareableLink reads the symlink rel below dir and checks it like the
+// client does when unpacking, see checkSymlink and unpackArchive, so a link
+// it would refuse is left out instead of failing the whole directory.
+func shareableLink(dir *os.Root, rel string) (string, error) {
+	target, err := dir.Readlink(rel)
+	if err != nil {
+		return "", err
+	}
+	if err := checkSymlink(rel, target); err != nil {
+		return "", err
+	}
+	if _, err := dir.Stat(rel); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: symlink %s points outside the directory", errUnsafeName, rel)
+	}
+	return target, nil
+}
+
+// writeArchive writes the contents of root as a tar archive to w. Headers
+// only carry what the receiver needs: names, permission bits without
+// setuid, setgid and sticky, sizes, link targets and whole-second mtimes.
+func writeArchive(w io.Writer, root string, format string) error {
+	out := w
+
+	var zw *zstd.Encoder
+	if format == wire.FormatTarZstd {
+		var err error
+		// A single encoder goroutine keeps the output the same on every run.
+		zw, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		out = zw
+	}
+
+	dir, err := os.OpenRoot(root)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	tw := tar.NewWriter(out)
+
+	err = filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == root {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !archivable(info.Mode()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime().Truncate(time.Second),
+		}
+
+		switch {
+		case info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case info.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+		default:
+			hdr.Typeflag = tar.TypeSymlink
+			// scanDir already warned about the links left out.
+			if hdr.Linkname, err = shareableLink(dir, rel); err != nil {
+				return nil
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			return copyFile(tw, filePath, hdr.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", root, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
+
+// copyFile writes exactly size bytes of the file at filePath to w.
+func copyFile(w io.Writer, filePath string, size int64) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(w, f, size); err != nil {
+		return fmt.Errorf("%s changed while it was being read: %w", filePath, err)
+	}
+	return nil
+}
+
+// unpackArchive extracts the archive read from src into the new directory
+// dir. Every entry has to stay inside dir: names are checked element by
+// element, all file system access goes through an os.Root, and symlinks
+// may only point at something within the archive. Permission bits are kept,
+// setuid, setgid and sticky bits never are.
+func unpackArchive(src io.Reader, format string, dir string) error {
+	r := src
+
+	switch format {
+	case wire.FormatTar:
+	case wire.FormatTarZstd:
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	type dirMode struct {
+		name string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+	var links []string
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name, err := archivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := root.Mkdir(name, 0700); err != nil {
+				return fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			// Applied at the end, a read-only directory must still be
+			// writable while we fill it.
+			dirs = append(dirs, dirMode{name, mode})
+		case tar.TypeReg:
+			if err := unpackFile(root, name, tr, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := checkSymlink(name, hdr.Linkname); err != nil {
+				return err
+			}
+			if err := root.Symlink(hdr.Linkname, name); err != nil {
+				return fmt.Errorf("failed to create %s: %w", name, err)
+			}
+			links = append(links, name)
+		default:
+			return fmt.Errorf("%w: %s has unsupported type %q", errUnsafeName, hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	// Links can resolve through other links. Now that all of them exist,
+	// make sure none of them ends up outside the directory.
+	for _, name := range links {
+		if _, err := root.Stat(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: symlink %s points outside the directory", errUnsafeName, name)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := root.Chmod(dirs[i].name, dirs[i].mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func unpackFile(root *os.Root, name string, src io.Reader, mode fs.FileMode) error {
+	f, err := root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+
+	_, err = io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return root.Chmod(name, mode)
+}
+
+// archivePath turns the slash separated name of an archive entry into a
+// relative path, checking every element like a single offered file name.
+func archivePath(name string) (string, error) {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" {
+		return "", fmt.Errorf("%w: empty name in archive", errUnsafeName)
+	}
+
+	elems := strings.Split(name, "/")
+	for _, elem := range elems {
+		if err := validateFileName(elem); err != nil {
+			return "", fmt.Errorf("archive entry %q: %w", name, err)
+		}
+	}
+
+	return filepath.Join(elems...), nil
+}
+
+// checkSymlink rejects link targets that are absolute or climb out of the
+// archive.
+func checkSymlink(name string, target string) error {
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) || strings.ContainsAny(target, `\:`) {
+		return fmt.Errorf("%w: symlink %s points to %q", errUnsafeName, name, target)
+	}
+
+	resolved := path.Join(path.Dir(filepath.ToSlash(name)), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("%w: symlink %s points outside the directory", errUnsafeName, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+func TestWriteArchiveSkipsLinksTheClientRefuses(t *testing.T) {
+	src := t.TempDir()
+	if err := os.Mkdir(filepath.Join(src, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(src, "sub", "a.env"), "secret")
+
+	links := map[string]string{
+		"inside":   "sub/a.env",
+		"up":       "../sub/a.env", // from sub/, still inside
+		"absolute": "/etc/passwd",
+		"escapes":  "../outside",
+		"chained":  "sub/out/x", // through sub/out, which escapes
+	}
+	for name, target := range links {
+		path := filepath.Join(src, name)
+		if name == "up" {
+			path = filepath.Join(src, "sub", name)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../..", filepath.Join(src, "sub", "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := writeArchive(&archive, src, wire.FormatTar); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "out")
+	if err := unpackArchive(&archive, wire.FormatTar, dst); err != nil {
+		t.Fatalf("client refused the archive: %v", err)
+	}
+
+	for _, name := range []string{"inside", "sub/up"} {
+		if got := readFile(t, filepath.Join(dst, name)); got != "secret" {
+			t.Errorf("%s holds %q", name, got)
+		}
+	}
+	for _, name := range []string{"absolute", "escapes", "chained", "sub/out"} {
+		if _, err := os.Lstat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was archived", name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// sealChunkSize is how much plaintext goes into each sealed chunk.
+	sealChunkSize = 64 << 10
+	sealSaltSize  = 16
+)
+
+var errTampered = errors.New("payload was damaged or tampered with")
+
+// sessionCipher encrypts payloads with ChaCha20-Poly1305 and signs with
+// HMAC-SHA256, under keys only the two sides of a PAKEHandshake share. Each
+// direction has keys of its own.
+//
+// A payload starts with a random salt that gives it a key of its own,
+// followed by sealed chunks. Each chunk's nonce holds its index and whether
+// it is the last, so chunks can't be reordered, dropped or cut off.
+type sessionCipher struct {
+	sealKey   []byte
+	openKey   []byte
+	signKey   []byte
+	verifyKey []byte
+}
+
+func payloadAEAD(key []byte, salt []byte) (cipher.AEAD, error) {
+	payloadKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("secretshare payload")), payloadKey); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(payloadKey)
+}
+
+func chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (c *sessionCipher) Encrypt(dst io.Writer, src io.Reader) error {
+	salt := make([]byte, sealSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := payloadAEAD(c.sealKey, salt)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(salt); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, sealChunkSize)
+	buf := make([]byte, sealChunkSize, sealChunkSize+aead.Overhead())
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		if _, err := dst.Write(aead.Seal(buf[:0], chunkNonce(index, last), buf[:n], nil)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (c *sessionCipher) Decrypt(dst io.Writer, src io.Reader) error {
+	salt := make([]byte, sealSaltSize)
+	if _, err := io.ReadFull(src, salt); err != nil {
+		return fmt.Errorf("%w: %v", errTampered, err)
+	}
+	aead, err := payloadAEAD(c.openKey, salt)
+	if err != nil {
+		return err
+	}
+
+	sealed := sealChunkSize + aead.Overhead()
+	in := bufio.NewReaderSize(src, sealed)
+	buf := make([]byte, sealed)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := err != nil
+		if !last {
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		plaintext, err := aead.Open(buf[:0], chunkNonce(index, last), buf[:n], nil)
+		if err != nil {
+			return errTampered
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (c *sessionCipher) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, c.signKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (c *sessionCipher) Verify(data []byte, signature []byte) error {
+	mac := hmac.New(sha256.New, c.verifyKey)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("signature does not match the session keys")
+	}
+	return nil
+}
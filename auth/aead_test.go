@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sealedChunkSize is how large each chunk is once sealed.
+const sealedChunkSize = sealChunkSize + chacha20poly1305.Overhead
+
+func testCiphers(t *testing.T) (host, client *sessionCipher) {
+	t.Helper()
+
+	secret := make([]byte, 64)
+	rand.Read(secret)
+	keys := &sessionKeys{secret: secret}
+	return keys.cipher(true), keys.cipher(false)
+}
+
+func seal(t *testing.T, c *sessionCipher, plaintext []byte) []byte {
+	t.Helper()
+
+	var ciphertext bytes.Buffer
+	if err := c.Encrypt(&ciphertext, bytes.NewReader(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext.Bytes()
+}
+
+func TestSessionCipherRoundTrip(t *testing.T) {
+	host, client := testCiphers(t)
+
+	for _, size := range []int{0, 1, sealChunkSize - 1, sealChunkSize, sealChunkSize + 1, 3 * sealChunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := seal(t, host, plaintext)
+		chunks := max(1, (size+sealChunkSize-1)/sealChunkSize)
+		if want := sealSaltSize + size + chunks*chacha20poly1305.Overhead; len(ciphertext) != want {
+			t.Errorf("%d bytes: ciphertext is %d bytes, want %d", size, len(ciphertext), want)
+		}
+
+		var got bytes.Buffer
+		if err := client.Decrypt(&got, bytes.NewReader(ciphertext)); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got.Bytes(), plaintext) {
+			t.Fatalf("%d bytes: round trip changed the plaintext", size)
+		}
+	}
+}
+
+func TestSessionCipherRejectsTampering(t *testing.T) {
+	host, client := testCiphers(t)
+
+	plaintext := make([]byte, 2*sealChunkSize+5)
+	rand.Read(plaintext)
+	ciphertext := seal(t, host, plaintext)
+	chunk := func(i int) []byte {
+		start := sealSaltSize + i*sealedChunkSize
+		return ciphertext[start:min(start+sealedChunkSize, len(ciphertext))]
+	}
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[sealSaltSize+sealChunkSize/2] ^= 1
+
+	flippedSalt := bytes.Clone(ciphertext)
+	flippedSalt[0] ^= 1
+
+	reordered := bytes.Join([][]byte{ciphertext[:sealSaltSize], chunk(1), chunk(0), chunk(2)}, nil)
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"truncated to the salt", ciphertext[:sealSaltSize]},
+		{"truncated inside the salt", ciphertext[:sealSaltSize-1]},
+		{"truncated at a chunk boundary", ciphertext[:sealSaltSize+2*sealedChunkSize]},
+		{"truncated inside a chunk", ciphertext[:len(ciphertext)-1]},
+		{"extended", append(bytes.Clone(ciphertext), 0)},
+		{"bit flipped", flipped},
+		{"salt flipped", flippedSalt},
+		{"reordered", reordered},
+	}
+	for _, tt := range tests {
+		err := client.Decrypt(io.Discard, bytes.NewReader(tt.ciphertext))
+		if !errors.Is(err, errTampered) {
+			t.Errorf("%s: Decrypt = %v, want %v", tt.name, err, errTampered)
+		}
+	}
+
+	// Each direction has its own keys, so a payload can't be reflected.
+	if err := host.Decrypt(io.Discard, bytes.NewReader(ciphertext)); !errors.Is(err, errTampered) {
+		t.Errorf("host decrypted its own payload: %v", err)
+	}
+}
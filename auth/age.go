@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Noah-Wilderom/secretshare/prompt"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// ageEncryptor encrypts to an age recipient, or decrypts with age
+// identities. A host has the client's recipient only, a client its own
+// identities only.
+type ageEncryptor struct {
+	recipient  age.Recipient
+	identities []age.Identity
+}
+
+func (e *ageEncryptor) Encrypt(dst io.Writer, src io.Reader) error {
+	if e.recipient == nil {
+		return errors.New("no age recipient to encrypt to")
+	}
+
+	w, err := age.Encrypt(dst, e.recipient)
+	if err != nil {
+		return fmt.Errorf("age encryption failed: %w", err)
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("age encryption failed: %w", err)
+	}
+	return w.Close()
+}
+
+func (e *ageEncryptor) Decrypt(dst io.Writer, src io.Reader) error {
+	r, err := age.Decrypt(src, e.identities...)
+	if err != nil {
+		return fmt.Errorf("age decryption failed: %w", err)
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return fmt.Errorf("age decryption failed: %w", err)
+	}
+	return nil
+}
+
+// AgeIdentity is the age key a client receives payloads with, either from
+// an age identity file or an ssh-ed25519 private key.
+type AgeIdentity struct {
+	// Recipient is the public half, an age1... string or an ssh-ed25519
+	// public key in authorized_keys form.
+	Recipient string
+
+	identities []age.Identity
+}
+
+// LoadAgeIdentity reads the age identity file, or OpenSSH ed25519 private
+// key, at path. A passphrase protected SSH key is only unlocked once it is
+// needed to decrypt.
+func LoadAgeIdentity(path string) (*AgeIdentity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		return loadSSHIdentity(path, data)
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	x25519, ok := identities[0].(*age.X25519Identity)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported age identity", path)
+	}
+
+	return &AgeIdentity{
+		Recipient:  x25519.Recipient().String(),
+		identities: identities,
+	}, nil
+}
+
+func loadSSHIdentity(path string, data []byte) (*AgeIdentity, error) {
+	var public ssh.PublicKey
+	var identity age.Identity
+
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case errors.As(err, &missing):
+		if missing.PublicKey == nil {
+			return nil, fmt.Errorf("%s: passphrase protected key without its public key", path)
+		}
+		public = missing.PublicKey
+		identity, err = agessh.NewEncryptedSSHIdentity(public, data, func() ([]byte, error) {
+			return prompt.Password(fmt.Sprintf("Passphrase for %s: ", path))
+		})
+	case err == nil:
+		public = signer.PublicKey()
+		identity, err = agessh.ParseIdentity(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if public.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("%s: only ssh-ed25519 keys can be used with age, not %s", path, public.Type())
+	}
+
+	return &AgeIdentity{
+		Recipient:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public))),
+		identities: []age.Identity{identity},
+	}, nil
+}
+
+// parseAgeRecipient reads a recipient announced by a client.
+func parseAgeRecipient(s string) (age.Recipient, error) {
+	if strings.HasPrefix(s, ssh.KeyAlgoED25519+" ") {
+		return agessh.ParseRecipient(s)
+	}
+	if strings.HasPrefix(s, "age1") {
+		return age.ParseX25519Recipient(s)
+	}
+	return nil, fmt.Errorf("unsupported age recipient %q", s)
+}
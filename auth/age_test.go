@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeKeyFile(t *testing.T, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sshPrivateKey(t *testing.T, key any) []byte {
+	t.Helper()
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+	x25519, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string][]byte{
+		"age":     []byte("# created: today\n" + x25519.String() + "\n"),
+		"ssh key": sshPrivateKey(t, ed25519Key),
+	}
+	for name, key := range keys {
+		identity, err := LoadAgeIdentity(writeKeyFile(t, key))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// What the host makes of the recipient the client announces.
+		recipient, err := parseAgeRecipient(identity.Recipient)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		host := &ageEncryptor{recipient: recipient}
+		client := &ageEncryptor{identities: identity.identities}
+
+		plaintext := []byte("API_KEY=secret\n")
+		var ciphertext bytes.Buffer
+		if err := host.Encrypt(&ciphertext, bytes.NewReader(plaintext)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var decrypted bytes.Buffer
+		if err := client.Decrypt(&decrypted, bytes.NewReader(ciphertext.Bytes())); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Fatalf("%s: decrypted %q, want %q", name, decrypted.Bytes(), plaintext)
+		}
+
+		other, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stranger := &ageEncryptor{identities: []age.Identity{other}}
+		if err := stranger.Decrypt(&decrypted, bytes.NewReader(ciphertext.Bytes())); err == nil {
+			t.Fatalf("%s: decrypted with another identity", name)
+		}
+
+		tampered := bytes.Clone(ciphertext.Bytes())
+		tampered[len(tampered)-1] ^= 1
+		if err := client.Decrypt(&decrypted, bytes.NewReader(tampered)); err == nil {
+			t.Fatalf("%s: decrypted tampered ciphertext", name)
+		}
+
+		if err := client.Encrypt(&ciphertext, bytes.NewReader(plaintext)); err == nil {
+			t.Fatalf("%s: encrypted without a recipient", name)
+		}
+	}
+}
+
+func TestParseAgeRecipientRejectsMalformed(t *testing.T) {
+	x25519, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPublic, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaAuthorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ecdsaPublic)))
+	_, ecdsaBlob, _ := strings.Cut(ecdsaAuthorized, " ")
+
+	valid := x25519.Recipient().String()
+	for _, recipient := range []string{
+		"",
+		"age1",
+		valid[:len(valid)-1],
+		valid + "q",
+		strings.Replace(valid, "age1", "age2", 1),
+		x25519.String(),
+		"ssh-ed25519 ",
+		"ssh-ed25519 AAAA",
+		"ssh-ed25519 " + ecdsaBlob,
+		ecdsaAuthorized,
+		" " + valid,
+	} {
+		if _, err := parseAgeRecipient(recipient); err == nil {
+			t.Errorf("%q: parsed without an error", recipient)
+		}
+	}
+}
+
+func TestLoadAgeIdentityRejectsOtherKeys(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"ecdsa key": sshPrivateKey(t, ecdsaKey),
+		"empty":     []byte("# nothing here\n"),
+		"garbage":   []byte("AGE-SECRET-KEY-1NOTAKEY\n"),
+	} {
+		if _, err := LoadAgeIdentity(writeKeyFile(t, data)); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AllowedSigners lists the SSH keys a host accepts without asking. It reads
+// authorized_keys files ("[options] key comment") as well as ssh-keygen's
+// allowed_signers files ("principals [options] key"). Keys limited to
+// namespaces other than signerNamespace are left out.
+type AllowedSigners struct {
+	signers map[string]allowedSigner // by authorized key
+}
+
+// signerNamespace is what a namespaces option has to allow for a key to be
+// accepted here.
+const signerNamespace = "secretshare"
+
+// allowedSigner is a listed key's name and when it may be used. A zero
+// time means no limit.
+type allowedSigner struct {
+	name        string
+	validAfter  time.Time
+	validBefore time.Time
+	namespaces  []string // patterns, nil for any
+}
+
+// LoadAllowedSigners reads the file at path.
+func LoadAllowedSigners(path string) (*AllowedSigners, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &AllowedSigners{signers: make(map[string]allowedSigner)}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, signer, err := parseSignerLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		if signer.allows(signerNamespace) {
+			a.signers[string(key.Marshal())] = signer
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// sshOptions are the options sshd and ssh-keygen know in authorized_keys
+// and allowed_signers files. Anything else in front of the key is taken to
+// be the principals of an allowed_signers line.
+var sshOptions = map[string]bool{
+	"agent-forwarding": true, "cert-authority": true, "command": true,
+	"environment": true, "expiry-time": true, "from": true,
+	"namespaces": true, "no-agent-forwarding": true, "no-port-forwarding": true,
+	"no-pty": true, "no-touch-required": true, "no-user-rc": true,
+	"no-x11-forwarding": true, "permitlisten": true, "permitopen": true,
+	"port-forwarding": true, "principals": true, "pty": true, "restrict": true,
+	"tunnel": true, "user-rc": true, "valid-after": true, "valid-before": true,
+	"verify-required": true, "x11-forwarding": true,
+}
+
+func areOptions(options []string) bool {
+	for _, option := range options {
+		name, _, _ := strings.Cut(option, "=")
+		if !sshOptions[strings.ToLower(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSignerLine reads an authorized_keys line or, failing that, an
+// allowed_signers line, whose principals come first. The principals name
+// the key, or else its comment does.
+func parseSignerLine(line string) (ssh.PublicKey, allowedSigner, error) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil || !areOptions(options) {
+		principals, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, allowedSigner{}, fmt.Errorf("no key in %q", line)
+		}
+		key, _, options, _, err = ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return nil, allowedSigner{}, err
+		}
+		comment = principals
+	}
+
+	signer := allowedSigner{name: comment}
+	if err := signer.applyOptions(options); err != nil {
+		return nil, allowedSigner{}, err
+	}
+	return key, signer, nil
+}
+
+// applyOptions honors the validity options of a line. Options that only
+// restrict SSH sessions don't matter here, any other option is refused
+// rather than ignored, since ignoring it could accept more than the file
+// says.
+func (s *allowedSigner) applyOptions(options []string) error {
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		value = strings.Trim(value, `"`)
+
+		var err error
+		switch strings.ToLower(name) {
+		case "valid-after":
+			s.validAfter, err = parseSSHTime(value)
+		case "valid-before", "expiry-time":
+			s.validBefore, err = parseSSHTime(value)
+		case "namespaces":
+			s.namespaces = strings.Split(value, ",")
+		case "restrict", "no-pty", "no-port-forwarding", "no-agent-forwarding", "no-x11-forwarding", "no-user-rc":
+		case "cert-authority":
+			return fmt.Errorf("certificate authorities are not supported, list the keys themselves")
+		default:
+			return fmt.Errorf("unsupported option %q", name)
+		}
+		if err != nil {
+			return fmt.Errorf("option %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// allows reports whether the key may sign in namespace. Like ssh's
+// match_pattern_list, a matching !pattern refuses the namespace whatever
+// else matches.
+func (s *allowedSigner) allows(namespace string) bool {
+	if s.namespaces == nil {
+		return true
+	}
+
+	allowed := false
+	for _, pattern := range s.namespaces {
+		negated := strings.HasPrefix(pattern, "!")
+		if !matchPattern(strings.TrimPrefix(pattern, "!"), namespace) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// matchPattern matches s against an ssh pattern, where * is any run of
+// characters and ? any single one.
+func matchPattern(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := range len(s) + 1 {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			_, size := utf8.DecodeRuneInString(s)
+			pattern, s = pattern[1:], s[size:]
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+// parseSSHTime reads a time the way ssh-keygen writes it, YYYYMMDD with
+// optional HHMM or HHMMSS, in local time unless it ends in Z.
+func parseSSHTime(value string) (time.Time, error) {
+	loc := time.Local
+	if trimmed, ok := strings.CutSuffix(value, "Z"); ok {
+		value, loc = trimmed, time.UTC
+	}
+
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			return time.ParseInLocation(layout, value, loc)
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time like 20250131 or 202501311200", value)
+}
+
+// Lookup returns the name the key is listed under. A key outside its
+// validity window is not listed.
+func (a *AllowedSigners) Lookup(key ssh.PublicKey) (string, bool) {
+	signer, ok := a.signers[string(key.Marshal())]
+	if !ok {
+		return "", false
+	}
+
+	now := time.Now()
+	if !signer.validAfter.IsZero() && now.Before(signer.validAfter) {
+		return "", false
+	}
+	if !signer.validBefore.IsZero() && !now.Before(signer.validBefore) {
+		return "", false
+	}
+	return signer.name, true
+}
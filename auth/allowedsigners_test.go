@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSSHKey(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func loadSigners(t *testing.T, lines ...string) (*AllowedSigners, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadAllowedSigners(path)
+}
+
+func TestAllowedSignersLookup(t *testing.T) {
+	tests := []struct {
+		line     string // %s is the key
+		wantName string // empty if the key must not be listed
+	}{
+		{"%s alice@example.com", "alice@example.com"},
+		{"alice@example.com %s", "alice@example.com"},
+		{`no-pty,no-port-forwarding %s alice`, "alice"},
+		{`alice@example.com valid-after="20000101",valid-before="29991231Z" %s`, "alice@example.com"},
+		{`alice@example.com valid-before="20000101" %s`, ""},
+		{`expiry-time="200001011200" %s alice`, ""},
+		{`alice@example.com valid-after="29991231" %s`, ""},
+		{`alice@example.com namespaces="git,secret*" %s`, "alice@example.com"},
+		{`alice@example.com namespaces="git" %s`, ""},
+		{`alice@example.com namespaces="s?cretsh*e" %s`, "alice@example.com"},
+		{`alice@example.com namespaces="[s]ecretshare" %s`, ""},
+		{`alice@example.com namespaces="*,!secretshare" %s`, ""},
+		{`alice@example.com namespaces="!secretshare,*" %s`, ""},
+		{`alice@example.com namespaces="!git,secret*" %s`, "alice@example.com"},
+		{`alice@example.com namespaces="!git" %s`, ""},
+	}
+	for _, tt := range tests {
+		key, authorized := newTestSSHKey(t)
+		line := strings.Replace(tt.line, "%s", authorized, 1)
+
+		signers, err := loadSigners(t, line)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.line, err)
+		}
+		name, ok := signers.Lookup(key)
+		if ok != (tt.wantName != "") || name != tt.wantName {
+			t.Errorf("%s: Lookup = %q, %v, want %q", tt.line, name, ok, tt.wantName)
+		}
+	}
+}
+
+func TestAllowedSignersRefusesUnsupportedOptions(t *testing.T) {
+	for _, line := range []string{
+		`cert-authority %s ca`,
+		`*@example.com cert-authority %s`,
+		`command="/bin/true" %s alice`,
+		`from="10.0.0.0/8" %s alice`,
+		`alice valid-before="tomorrow" %s`,
+	} {
+		_, authorized := newTestSSHKey(t)
+		if _, err := loadSigners(t, strings.Replace(line, "%s", authorized, 1)); err == nil {
+			t.Errorf("%s: loaded without an error", line)
+		}
+	}
+}
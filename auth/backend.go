@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"fmt"
+	"io"
+)
+
+// Key is a secret key the local user can sign and decrypt with.
+type Key struct {
+	Fingerprint string
+	UserID      string
+}
+
+// Backend performs the OpenPGP operations secretshare needs.
+//
+// Public keys of remote peers go into a keyring private to the backend via
+// Import and are only usable as encryption recipients after Trust. Close
+// discards that keyring.
+type Backend interface {
+	ListSecretKeys() ([]Key, error)
+	Export(fingerprint string) ([]byte, error)
+	Import(publicKey []byte) ([]string, error)
+	UserIDs(fingerprint string) ([]string, error)
+	Trust(fingerprint string) error
+	Encrypt(dst io.Writer, src io.Reader, recipientFingerprint string) error
+	Decrypt(dst io.Writer, src io.Reader) error
+	Sign(data []byte, signerFingerprint string) ([]byte, error)
+	Verify(data []byte, signature []byte) (string, error)
+	Close() error
+}
+
+const (
+	BackendGPG    = "gpg"
+	BackendNative = "native"
+)
+
+// NewBackend returns the backend called name. keyPath is only used by the
+// native backend and points at an armored key file or a directory of them.
+func NewBackend(name string, keyPath string) (Backend, error) {
+	switch name {
+	case BackendGPG:
+		return NewGPGBackend()
+	case BackendNative:
+		return NewNativeBackend(keyPath)
+	default:
+		return nil, fmt.Errorf("unknown OpenPGP backend %q (want %s or %s)", name, BackendGPG, BackendNative)
+	}
+}
+
+// DefaultKey returns the first secret key of the backend.
+func DefaultKey(b Backend) (Key, error) {
+	keys, err := b.ListSecretKeys()
+	if err != nil {
+		return Key{}, err
+	}
+	if len(keys) == 0 {
+		return Key{}, fmt.Errorf("no GPG key found")
+	}
+	return keys[0], nil
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const nonceSize = 32
+
+const (
+	roleHost   = "host"
+	roleClient = "client"
+)
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// challenge is the statement each side signs during the handshake. It binds
+// the signer's role, both nonces, both GPG fingerprints, both libp2p peer IDs
+// and the protocol the stream was opened for. A signature obtained from a
+// victim on one connection is therefore useless on any other: relaying it
+// changes at least one of the peer IDs. The encryptions the client offered
+// and the one the host picked are bound too, so neither can be swapped.
+type challenge struct {
+	protocol          protocol.ID
+	clientNonce       []byte
+	hostNonce         []byte
+	clientFingerprint string
+	hostFingerprint   string
+	clientPeer        peer.ID
+	hostPeer          peer.ID
+	encryptions       []string
+	ageRecipient      string
+	encryption        string
+}
+
+func (c challenge) statement(role string) []byte {
+	var encryptions [][]byte
+	for _, encryption := range c.encryptions {
+		encryptions = append(encryptions, []byte(encryption))
+	}
+
+	return transcript(
+		[]byte("secretshare-handshake"),
+		[]byte(role),
+		[]byte(c.protocol),
+		c.clientNonce,
+		c.hostNonce,
+		[]byte(c.clientFingerprint),
+		[]byte(c.hostFingerprint),
+		[]byte(c.clientPeer),
+		[]byte(c.hostPeer),
+		transcript(encryptions...),
+		[]byte(c.ageRecipient),
+		[]byte(c.encryption),
+	)
+}
+
+// transcript joins fields, each prefixed with its length so no two lists of
+// fields encode the same.
+func transcript(fields ...[]byte) []byte {
+	var buf []byte
+	for _, field := range fields {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testChallenge(t *testing.T) challenge {
+	t.Helper()
+
+	clientNonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostNonce, err := newNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge{
+		protocol:          "/secretshare/1.0.0",
+		clientNonce:       clientNonce,
+		hostNonce:         hostNonce,
+		clientFingerprint: "CLIENT",
+		hostFingerprint:   "HOST",
+		clientPeer:        newTestPeerID(t),
+		hostPeer:          newTestPeerID(t),
+		encryptions:       []string{EncryptionGPG, EncryptionAge},
+		ageRecipient:      "age1recipient",
+		encryption:        EncryptionAge,
+	}
+}
+
+// challengeVariants returns c as it would look on other connections, or
+// with parts of it swapped by someone relaying the handshake.
+func challengeVariants(t *testing.T, c challenge) map[string]challenge {
+	t.Helper()
+
+	variants := make(map[string]challenge)
+	change := func(name string, edit func(*challenge)) {
+		v := c
+		edit(&v)
+		variants[name] = v
+	}
+
+	change("another protocol", func(v *challenge) { v.protocol = "/secretshare/0.9.0" })
+	change("client and host peer swapped", func(v *challenge) { v.clientPeer, v.hostPeer = v.hostPeer, v.clientPeer })
+	change("another client peer", func(v *challenge) { v.clientPeer = newTestPeerID(t) })
+	change("another host peer", func(v *challenge) { v.hostPeer = newTestPeerID(t) })
+	change("nonces swapped", func(v *challenge) { v.clientNonce, v.hostNonce = v.hostNonce, v.clientNonce })
+	change("another host nonce", func(v *challenge) { v.hostNonce = bytes.Repeat([]byte{1}, nonceSize) })
+	change("fingerprints swapped", func(v *challenge) {
+		v.clientFingerprint, v.hostFingerprint = v.hostFingerprint, v.clientFingerprint
+	})
+	change("fewer encryptions offered", func(v *challenge) { v.encryptions = []string{EncryptionAge} })
+	change("another encryption picked", func(v *challenge) { v.encryption = EncryptionGPG })
+	change("another age recipient", func(v *challenge) { v.ageRecipient = "age1other" })
+	return variants
+}
+
+func TestChallengeBindsConnection(t *testing.T) {
+	client, clientFingerprint := newTestBackend(t, "Client", "client@example.org")
+	host, _ := newTestBackend(t, "Host", "host@example.org")
+
+	publicKey, err := client.Export(clientFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := host.Import(publicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	c := testChallenge(t)
+	signature, err := client.Sign(c.statement(roleClient), clientFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer, err := host.Verify(c.statement(roleClient), signature); err != nil || signer != clientFingerprint {
+		t.Fatalf("Verify = %s, %v", signer, err)
+	}
+
+	if _, err := host.Verify(c.statement(roleHost), signature); err == nil {
+		t.Error("the client's proof passed as the host's")
+	}
+	for name, v := range challengeVariants(t, c) {
+		if _, err := host.Verify(v.statement(roleClient), signature); err == nil {
+			t.Errorf("%s: proof accepted", name)
+		}
+	}
+}
+
+func TestSSHChallengeBindsConnection(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &SSHHandshake{key: &SSHKey{signer: signer}}
+
+	c := testChallenge(t)
+	signature, err := h.sign(c.statement(roleHost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySSH(signer.PublicKey(), c.statement(roleHost), signature); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifySSH(signer.PublicKey(), c.statement(roleClient), signature); err == nil {
+		t.Error("the host's proof passed as the client's")
+	}
+	for name, v := range challengeVariants(t, c) {
+		if err := verifySSH(signer.PublicKey(), v.statement(roleHost), signature); err == nil {
+			t.Errorf("%s: proof accepted", name)
+		}
+	}
+}
+
+func TestTranscriptIsUnambiguous(t *testing.T) {
+	encodings := [][]byte{
+		transcript([]byte("ab"), []byte("c")),
+		transcript([]byte("a"), []byte("bc")),
+		transcript([]byte("abc")),
+		transcript([]byte("abc"), nil),
+		transcript(nil, []byte("abc")),
+		transcript(),
+	}
+	for i := range encodings {
+		for j := range i {
+			if bytes.Equal(encodings[i], encodings[j]) {
+				t.Errorf("field lists %d and %d encode the same", j, i)
+			}
+		}
+	}
+}
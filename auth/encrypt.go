@@ -4,133 +4,116 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 )
 
-func GetGPGFingerprint() (string, error) {
-	cmd := exec.Command("gpg", "--list-secret-keys", "--with-colons")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to list GPG keys: %w", err)
-	}
-
-	lines := bytes.Split(output, []byte("\n"))
-	for _, line := range lines {
-		fields := bytes.Split(line, []byte(":"))
-		if len(fields) > 0 && string(fields[0]) == "fpr" {
-			// Return the first fingerprint found
-			return string(fields[9]), nil
-		}
-	}
-
-	return "", fmt.Errorf("no GPG fingerprint found")
+// GPGBackend shells out to the gpg binary. Secret key operations use the
+// user's own keyring, peer keys live in a temporary Keyring.
+type GPGBackend struct {
+	*Keyring
 }
 
-// ExportPublicKey exports the public key for a given fingerprint in ASCII armor format
-func ExportPublicKey(fingerprint string) (string, error) {
-	cmd := exec.Command("gpg", "--armor", "--export", fingerprint)
-	output, err := cmd.Output()
+func NewGPGBackend() (*GPGBackend, error) {
+	keyring, err := NewKeyring()
 	if err != nil {
-		return "", fmt.Errorf("failed to export public key: %w", err)
+		return nil, err
 	}
-	return string(output), nil
-}
-
-// ImportPublicKey imports a public key into the GPG keyring
-func ImportPublicKey(publicKey string) error {
-	cmd := exec.Command("gpg", "--import", "--batch")
-	cmd.Stdin = bytes.NewReader([]byte(publicKey))
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to import public key: %v\nStderr: %s\nStdout: %s", err, stderr.String(), stdout.String())
-	}
-
-	// Log what GPG said about the import
-	fmt.Printf("GPG import output:\nStderr: %s\nStdout: %s\n", stderr.String(), stdout.String())
-	return nil
+	return &GPGBackend{Keyring: keyring}, nil
 }
 
-// VerifyKeyExists checks if a key with the given fingerprint exists in the keyring
-func VerifyKeyExists(fingerprint string) (bool, error) {
-	cmd := exec.Command("gpg", "--list-keys", "--with-colons", fingerprint)
+func (b *GPGBackend) ListSecretKeys() ([]Key, error) {
+	cmd := exec.Command("gpg", "--list-secret-keys", "--with-colons")
 	output, err := cmd.Output()
 	if err != nil {
-		return false, nil // Key doesn't exist
+		return nil, fmt.Errorf("failed to list GPG keys: %w", err)
 	}
 
-	// Check if the output contains the fingerprint
+	// Every "sec" record starts a key. The first "fpr" after it is the
+	// primary key's fingerprint, the first "uid" its primary user ID.
+	var keys []Key
 	lines := bytes.Split(output, []byte("\n"))
 	for _, line := range lines {
-		fields := bytes.Split(line, []byte(":"))
-		if len(fields) > 0 && string(fields[0]) == "fpr" {
-			if string(fields[9]) == fingerprint {
-				return true, nil
+		fields := strings.Split(string(line), ":")
+		if len(fields) < 10 {
+			continue
+		}
+
+		switch fields[0] {
+		case "sec":
+			keys = append(keys, Key{})
+		case "fpr":
+			if len(keys) > 0 && keys[len(keys)-1].Fingerprint == "" {
+				keys[len(keys)-1].Fingerprint = fields[9]
+			}
+		case "uid":
+			if len(keys) > 0 && keys[len(keys)-1].UserID == "" {
+				keys[len(keys)-1].UserID = unescapeColons(fields[9])
 			}
 		}
 	}
 
-	return false, nil
+	return keys, nil
+}
+
+// unescapeColons undoes the \xHH escaping gpg applies to --with-colons values.
+func unescapeColons(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
 }
 
-func EncryptFile(filePath string, recipientFingerprint string) ([]byte, error) {
-	fileData, err := os.ReadFile(filePath)
+// Export exports the public key for a given fingerprint in ASCII armor format
+func (b *GPGBackend) Export(fingerprint string) ([]byte, error) {
+	cmd := exec.Command("gpg", "--armor", "--export", fingerprint)
+	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
+		return nil, fmt.Errorf("failed to export public key: %w", err)
 	}
+	return output, nil
+}
 
-	cmd := exec.Command("gpg", "--encrypt", "--recipient", recipientFingerprint, "--trust-model", "always", "--armor")
-	cmd.Stdin = bytes.NewReader(fileData)
+// Sign creates a detached binary signature over data with the secret key
+// identified by signerFingerprint.
+func (b *GPGBackend) Sign(data []byte, signerFingerprint string) ([]byte, error) {
+	cmd := exec.Command("gpg", "--batch", "--local-user", signerFingerprint, "--detach-sign")
+	cmd.Stdin = bytes.NewReader(data)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("GPG encryption failed: %v\nStderr: %s", err, stderr.String())
+		return nil, fmt.Errorf("GPG signing failed: %v\nStderr: %s", err, stderr.String())
 	}
 
 	return stdout.Bytes(), nil
 }
 
-func DecryptData(encryptedData []byte, outputPath string) error {
+// Decrypt feeds src into gpg and writes the plaintext to dst as it is
+// produced, so memory use doesn't grow with the message size.
+func (b *GPGBackend) Decrypt(dst io.Writer, src io.Reader) error {
 	cmd := exec.Command("gpg", "--decrypt", "--batch", "--yes")
-	cmd.Stdin = bytes.NewReader(encryptedData)
+	cmd.Stdin = src
+	cmd.Stdout = dst
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
+	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("GPG decryption failed: %v\nStderr: %s", err, stderr.String())
 	}
 
-	if err := os.WriteFile(outputPath, stdout.Bytes(), 0600); err != nil {
-		return fmt.Errorf("failed to write decrypted file: %w", err)
-	}
-
 	return nil
 }
-
-func StreamEncryptFile(filePath string, recipientFingerprint string, writer io.Writer) error {
-	encryptedData, err := EncryptFile(filePath, recipientFingerprint)
-	if err != nil {
-		return err
-	}
-
-	_, err = writer.Write(encryptedData)
-	return err
-}
-
-func StreamDecryptData(reader io.Reader, outputPath string) error {
-	encryptedData, err := io.ReadAll(reader)
-	if err != nil {
-		return fmt.Errorf("failed to read encrypted data: %w", err)
-	}
-
-	return DecryptData(encryptedData, outputPath)
-}
@@ -1,217 +1,446 @@
 package auth
 
 import (
-	"bufio"
 	"fmt"
+	"io"
 	"log"
-	"os"
-	"os/exec"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/Noah-Wilderom/secretshare/prompt"
+	"github.com/Noah-Wilderom/secretshare/wire"
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-func min(a, b int) int {
-	if a < b {
-		return a
-	}
-	return b
-}
-
 type GPGHandshake struct {
-	isHost            bool
-	clientFingerprint string // Stores the client's GPG fingerprint after successful handshake
+	// Encryptions the host picks from, in order of preference. GPG by
+	// default.
+	Encryptions []string
+	// AgeIdentity lets a client offer age encryption.
+	AgeIdentity *AgeIdentity
+	// Policy lets a host accept or deny clients without asking, nil to
+	// ask about every one.
+	Policy *Policy
+
+	isHost  bool
+	backend Backend     // Signs our challenges and holds the peer keys imported during the handshake
+	known   *KnownPeers // Hosts trusted before, nil to not keep track
 }
 
-func NewGPGHandshake(isHost bool) *GPGHandshake {
+func NewGPGHandshake(isHost bool, backend Backend, known *KnownPeers) *GPGHandshake {
 	return &GPGHandshake{
-		isHost:            isHost,
-		clientFingerprint: "",
+		Encryptions: []string{EncryptionGPG},
+		isHost:      isHost,
+		backend:     backend,
+		known:       known,
 	}
 }
 
-func (h *GPGHandshake) GetClientFingerprint() string {
-	return h.clientFingerprint
+// Close wipes the peer keys imported during handshakes.
+func (h *GPGHandshake) Close() error {
+	return h.backend.Close()
 }
 
-func getDefaultGPGKey() (string, error) {
-	cmd := exec.Command("gpg", "--list-secret-keys", "--keyid-format", "LONG")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to list GPG keys: %w", err)
-	}
+// The prompts name the kind of key the peer proved, "GPG user" or "SSH key".
+const (
+	kindGPG = "GPG user"
+	kindSSH = "SSH key"
+)
 
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "uid") {
-			parts := strings.SplitN(line, "]", 2)
-			if len(parts) == 2 {
-				userID := strings.TrimSpace(parts[1])
-				return userID, nil
-			}
-		}
-	}
+func promptUserAcceptance(kind string, userName string, fingerprint string) bool {
+	return prompt.Confirm(fmt.Sprintf("\nIncoming connection from %s: %s\nFingerprint: %s\nAccept connection?", kind, userName, fingerprint))
+}
 
-	return "", fmt.Errorf("no GPG key found")
+func promptHostTrust(kind string, userName string, fingerprint string, note string) bool {
+	if note != "" {
+		note += "\n"
+	}
+	return prompt.Confirm(fmt.Sprintf("\nHost identified as %s: %s\nFingerprint: %s\n%sIs this the person you expect to receive a secret from?", kind, userName, fingerprint, note))
 }
 
-func promptUserAcceptance(gpgUserName string) bool {
-	fmt.Printf("\nIncoming connection from GPG user: %s\n", gpgUserName)
-	fmt.Print("Accept connection? (y/N): ")
+// localHello announces our own GPG identity together with a fresh nonce.
+func (h *GPGHandshake) localHello() (*wire.Hello, error) {
+	key, err := DefaultKey(h.backend)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default GPG key: %w", err)
+	}
+	userID, fingerprint := key.UserID, key.Fingerprint
 
-	reader := bufio.NewReader(os.Stdin)
-	response, err := reader.ReadString('\n')
+	publicKey, err := h.backend.Export(fingerprint)
 	if err != nil {
-		log.Printf("Failed to read user input: %v\n", err)
-		return false
+		return nil, err
 	}
 
-	response = strings.TrimSpace(strings.ToLower(response))
-	return response == "y" || response == "yes"
-}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
 
-func (h *GPGHandshake) Handshake(s network.Stream) bool {
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	log.Printf("Using GPG identity: %s (fingerprint: %s)\n", userID, fingerprint)
 
-	if h.isHost {
-		gpgUserName, err := rw.ReadString('\n')
-		if err != nil {
-			log.Printf("Failed to read GPG user ID from client: %v\n", err)
-			return false
-		}
+	return &wire.Hello{
+		UserID:      userID,
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey,
+		Nonce:       nonce,
+	}, nil
+}
 
-		gpgUserName = strings.TrimSpace(gpgUserName)
-		if gpgUserName == "" {
-			log.Println("Client sent empty GPG user ID")
-			return false
-		}
+func validateHello(hello *wire.Hello) error {
+	switch {
+	case strings.TrimSpace(hello.UserID) == "":
+		return fmt.Errorf("peer sent empty GPG user ID")
+	case strings.ContainsFunc(hello.UserID, unicode.IsControl):
+		return fmt.Errorf("peer sent a GPG user ID with control characters")
+	case strings.TrimSpace(hello.Fingerprint) == "":
+		return fmt.Errorf("peer sent empty GPG fingerprint")
+	case !validFingerprint(hello.Fingerprint):
+		return fmt.Errorf("peer sent malformed GPG fingerprint %q", hello.Fingerprint)
+	case len(hello.PublicKey) == 0:
+		return fmt.Errorf("peer sent no public key")
+	case len(hello.Nonce) != nonceSize:
+		return fmt.Errorf("peer sent a %d byte nonce, want %d", len(hello.Nonce), nonceSize)
+	}
+	return nil
+}
 
-		fingerprint, err := rw.ReadString('\n')
-		if err != nil {
-			log.Printf("Failed to read GPG fingerprint from client: %v\n", err)
+// validFingerprint accepts full v4 (40 hex digits) or v5 (64 hex digits)
+// fingerprints in GPG's upper case form. Short key IDs are not enough to
+// pin an identity.
+func validFingerprint(fingerprint string) bool {
+	if len(fingerprint) != 40 && len(fingerprint) != 64 {
+		return false
+	}
+	for _, r := range fingerprint {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'F') {
 			return false
 		}
+	}
+	return true
+}
 
-		fingerprint = strings.TrimSpace(fingerprint)
-		if fingerprint == "" {
-			log.Println("Client sent empty GPG fingerprint")
-			return false
+// offeredEncryptions lists what the client can decrypt.
+func (h *GPGHandshake) offeredEncryptions() []string {
+	if h.AgeIdentity != nil {
+		return []string{EncryptionGPG, EncryptionAge}
+	}
+	return []string{EncryptionGPG}
+}
+
+// pickEncryption chooses the first of our encryptions the client offered,
+// and returns the encryptor for it.
+func (h *GPGHandshake) pickEncryption(clientHello *wire.Hello) (string, Encryptor, error) {
+	for _, encryption := range h.Encryptions {
+		if !slices.Contains(clientHello.Encryptions, encryption) {
+			continue
 		}
 
-		// Read the public key from client
-		var publicKeyBuilder strings.Builder
-		for {
-			line, err := rw.ReadString('\n')
+		switch encryption {
+		case EncryptionGPG:
+			return encryption, &gpgEncryptor{backend: h.backend, peer: clientHello.Fingerprint}, nil
+		case EncryptionAge:
+			recipient, err := parseAgeRecipient(clientHello.AgeRecipient)
 			if err != nil {
-				log.Printf("Failed to read public key: %v\n", err)
-				return false
-			}
-			if strings.Contains(line, "<<<END_PUBLIC_KEY>>>") {
-				break
+				return "", nil, err
 			}
-			publicKeyBuilder.WriteString(line)
+			return encryption, &ageEncryptor{recipient: recipient}, nil
 		}
-		publicKey := publicKeyBuilder.String()
+	}
+	return "", nil, fmt.Errorf("client supports %s, host only %s", strings.Join(clientHello.Encryptions, ", "), strings.Join(h.Encryptions, ", "))
+}
 
-		// Import the client's public key
-		log.Println("Importing client's GPG public key...")
-		log.Printf("Public key length: %d bytes\n", len(publicKey))
-		log.Printf("First 100 chars: %s\n", publicKey[:min(100, len(publicKey))])
+// verifyPeer imports the public key the peer announced and checks that its
+// proof is a valid signature over statement made by that very key. Only then
+// is the announced fingerprint treated as authenticated. It returns the user
+// IDs on the key, which the announced user ID has to be one of.
+func (h *GPGHandshake) verifyPeer(hello *wire.Hello, proof *wire.Proof, statement []byte) ([]string, error) {
+	imported, err := h.backend.Import(hello.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to import peer's public key: %w", err)
+	}
 
-		if err := ImportPublicKey(publicKey); err != nil {
-			log.Printf("Failed to import client's public key: %v\n", err)
-			return false
-		}
-		log.Println("Successfully imported client's public key")
+	if !slices.Contains(imported, hello.Fingerprint) {
+		return nil, fmt.Errorf("public key block does not contain key %s", hello.Fingerprint)
+	}
 
-		// Verify the key actually exists in the keyring
-		exists, err := VerifyKeyExists(fingerprint)
-		if err != nil {
-			log.Printf("Error verifying key import: %v\n", err)
-			return false
-		}
-		if !exists {
-			log.Printf("Key import reported success but key %s not found in keyring!\n", fingerprint)
-			return false
-		}
-		log.Printf("Verified key %s exists in keyring\n", fingerprint)
+	signer, err := h.backend.Verify(statement, proof.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if signer != hello.Fingerprint {
+		return nil, fmt.Errorf("challenge signed by %s, expected %s", signer, hello.Fingerprint)
+	}
 
-		h.clientFingerprint = fingerprint
+	userIDs, err := h.backend.UserIDs(hello.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(userIDs, hello.UserID) {
+		return nil, fmt.Errorf("user ID %q is not on key %s", hello.UserID, hello.Fingerprint)
+	}
 
-		accepted := promptUserAcceptance(gpgUserName)
+	return userIDs, nil
+}
 
-		var response string
-		if accepted {
-			response = "ACCEPTED\n"
-			log.Printf("Connection accepted from: %s (fingerprint: %s)\n", gpgUserName, fingerprint)
-		} else {
-			response = "REJECTED\n"
-			log.Printf("Connection rejected from: %s\n", gpgUserName)
-		}
+func (h *GPGHandshake) Handshake(s network.Stream) (*Result, error) {
+	codec := wire.NewCodec(s)
 
-		_, err = rw.WriteString(response)
-		if err != nil {
-			log.Printf("Failed to send response to client: %v\n", err)
-			return false
-		}
-		rw.Flush()
+	if h.isHost {
+		return h.hostHandshake(s, codec)
+	}
+	return h.clientHandshake(s, codec)
+}
 
-		return accepted
-	} else {
-		gpgUserID, err := getDefaultGPGKey()
-		if err != nil {
-			log.Printf("Failed to get default GPG key: %v\n", err)
-			return false
-		}
+func (h *GPGHandshake) hostHandshake(s network.Stream, codec *wire.Codec) (*Result, error) {
+	clientHello, err := wire.Expect[*wire.Hello](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello from client: %w", err)
+	}
 
-		fingerprint, err := GetGPGFingerprint()
-		if err != nil {
-			log.Printf("Failed to get GPG fingerprint: %v\n", err)
-			return false
-		}
+	if err := validateHello(clientHello); err != nil {
+		return nil, fmt.Errorf("invalid hello from client: %w", err)
+	}
 
-		log.Printf("Using GPG identity: %s (fingerprint: %s)\n", gpgUserID, fingerprint)
+	encryption, encryptor, err := h.pickEncryption(clientHello)
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "no encryption both sides support"})
+		return nil, fmt.Errorf("no common encryption: %w", err)
+	}
 
-		// Export public key for the host to import
-		publicKey, err := ExportPublicKey(fingerprint)
-		if err != nil {
-			log.Printf("Failed to export public key: %v\n", err)
-			return false
-		}
+	hello, err := h.localHello()
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "host has no usable GPG identity"})
+		return nil, err
+	}
+	hello.Encryption = encryption
 
-		_, err = rw.WriteString(gpgUserID + "\n")
-		if err != nil {
-			log.Printf("Failed to send GPG user ID: %v\n", err)
-			return false
-		}
+	if err := codec.WriteMessage(hello); err != nil {
+		return nil, fmt.Errorf("failed to send hello to client: %w", err)
+	}
 
-		_, err = rw.WriteString(fingerprint + "\n")
-		if err != nil {
-			log.Printf("Failed to send GPG fingerprint: %v\n", err)
-			return false
-		}
+	c := challenge{
+		protocol:          s.Protocol(),
+		clientNonce:       clientHello.Nonce,
+		hostNonce:         hello.Nonce,
+		clientFingerprint: clientHello.Fingerprint,
+		hostFingerprint:   hello.Fingerprint,
+		clientPeer:        s.Conn().RemotePeer(),
+		hostPeer:          s.Conn().LocalPeer(),
+		encryptions:       clientHello.Encryptions,
+		ageRecipient:      clientHello.AgeRecipient,
+		encryption:        encryption,
+	}
 
-		// Send the public key (use a delimiter to mark the end)
-		_, err = rw.WriteString(publicKey + "<<<END_PUBLIC_KEY>>>\n")
-		if err != nil {
-			log.Printf("Failed to send public key: %v\n", err)
-			return false
+	proof, err := wire.Expect[*wire.Proof](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proof from client: %w", err)
+	}
+
+	log.Println("Verifying client's GPG identity...")
+	userIDs, err := h.verifyPeer(clientHello, proof, c.statement(roleClient))
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "identity proof rejected"})
+		return nil, fmt.Errorf("client failed to prove its GPG identity: %w", err)
+	}
+	log.Printf("Client proved ownership of key %s\n", clientHello.Fingerprint)
+
+	decision := Decision{Action: ActionPrompt}
+	if h.Policy != nil {
+		decision = h.Policy.Decide(clientHello.Fingerprint, userIDs, time.Now())
+		log.Printf("Policy says %s for %s (%s), matching rule: %s\n", decision.Action, clientHello.UserID, clientHello.Fingerprint, decision.Rule)
+	}
+
+	switch decision.Action {
+	case ActionDeny:
+		codec.WriteMessage(&wire.Reject{Reason: "connection rejected by host"})
+		return nil, fmt.Errorf("%w: connection from %s denied by policy %s", ErrRejected, clientHello.UserID, decision.Rule)
+	case ActionPrompt:
+		if !promptUserAcceptance(kindGPG, clientHello.UserID, clientHello.Fingerprint) {
+			codec.WriteMessage(&wire.Reject{Reason: "connection rejected by host"})
+			return nil, fmt.Errorf("%w: connection from %s declined", ErrRejected, clientHello.UserID)
 		}
-		rw.Flush()
+	}
 
-		response, err := rw.ReadString('\n')
-		if err != nil {
-			log.Printf("Failed to read response from host: %v\n", err)
-			return false
+	if err := h.backend.Trust(clientHello.Fingerprint); err != nil {
+		codec.WriteMessage(&wire.Error{Message: "host failed to trust client key"})
+		return nil, err
+	}
+
+	signature, err := h.backend.Sign(c.statement(roleHost), hello.Fingerprint)
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "host failed to sign challenge"})
+		return nil, fmt.Errorf("failed to sign challenge: %w", err)
+	}
+
+	if err := codec.WriteMessage(&wire.Proof{Signature: signature}); err != nil {
+		return nil, fmt.Errorf("failed to send proof to client: %w", err)
+	}
+
+	log.Printf("Connection accepted from: %s (fingerprint: %s)\n", clientHello.UserID, clientHello.Fingerprint)
+
+	recipientKey := clientHello.Fingerprint
+	if encryption == EncryptionAge {
+		recipientKey = clientHello.AgeRecipient
+	}
+	result := h.result(s, clientHello, hello.Fingerprint, encryptor, recipientKey)
+	result.Files = decision.Files
+	return result, nil
+}
+
+func (h *GPGHandshake) clientHandshake(s network.Stream, codec *wire.Codec) (*Result, error) {
+	hello, err := h.localHello()
+	if err != nil {
+		return nil, err
+	}
+	hello.Encryptions = h.offeredEncryptions()
+	if h.AgeIdentity != nil {
+		hello.AgeRecipient = h.AgeIdentity.Recipient
+	}
+
+	if err := codec.WriteMessage(hello); err != nil {
+		return nil, fmt.Errorf("failed to send hello to host: %w", err)
+	}
+
+	hostHello, err := wire.Expect[*wire.Hello](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello from host: %w", err)
+	}
+
+	if err := validateHello(hostHello); err != nil {
+		return nil, fmt.Errorf("invalid hello from host: %w", err)
+	}
+
+	var encryptor Encryptor
+	switch {
+	case !slices.Contains(hello.Encryptions, hostHello.Encryption):
+		return nil, fmt.Errorf("host picked encryption %q, which the client did not offer", hostHello.Encryption)
+	case hostHello.Encryption == EncryptionAge:
+		encryptor = &ageEncryptor{identities: h.AgeIdentity.identities}
+	default:
+		encryptor = &gpgEncryptor{backend: h.backend, peer: hostHello.Fingerprint}
+	}
+
+	c := challenge{
+		protocol:          s.Protocol(),
+		clientNonce:       hello.Nonce,
+		hostNonce:         hostHello.Nonce,
+		clientFingerprint: hello.Fingerprint,
+		hostFingerprint:   hostHello.Fingerprint,
+		clientPeer:        s.Conn().LocalPeer(),
+		hostPeer:          s.Conn().RemotePeer(),
+		encryptions:       hello.Encryptions,
+		ageRecipient:      hello.AgeRecipient,
+		encryption:        hostHello.Encryption,
+	}
+
+	signature, err := h.backend.Sign(c.statement(roleClient), hello.Fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign challenge: %w", err)
+	}
+
+	if err := codec.WriteMessage(&wire.Proof{Signature: signature}); err != nil {
+		return nil, fmt.Errorf("failed to send proof to host: %w", err)
+	}
+
+	response, err := codec.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from host: %w", err)
+	}
+
+	var proof *wire.Proof
+	switch m := response.(type) {
+	case *wire.Proof:
+		proof = m
+	case *wire.Reject:
+		return nil, fmt.Errorf("%w by host: %s", ErrRejected, m.Reason)
+	case *wire.Error:
+		return nil, fmt.Errorf("handshake aborted by host: %w", m)
+	default:
+		return nil, fmt.Errorf("%w: got %s during handshake", wire.ErrUnexpectedMessage, m.Type())
+	}
+
+	log.Println("Connection accepted by host, verifying host's GPG identity...")
+	if _, err := h.verifyPeer(hostHello, proof, c.statement(roleHost)); err != nil {
+		return nil, fmt.Errorf("host failed to prove its GPG identity: %w", err)
+	}
+
+	result := h.result(s, hostHello, hello.Fingerprint, encryptor, hostHello.Fingerprint)
+
+	var note string
+	if h.known != nil {
+		if note, err = h.known.Check(result.Peer); err != nil {
+			codec.WriteMessage(&wire.Reject{Reason: "host does not match the client's known peers"})
+			return nil, err
 		}
+	}
 
-		response = strings.TrimSpace(response)
-		if response == "ACCEPTED" {
-			log.Println("Connection accepted by host")
-			return true
-		} else {
-			log.Printf("Connection rejected by host: %s\n", response)
-			return false
+	if !promptHostTrust(kindGPG, hostHello.UserID, hostHello.Fingerprint, note) {
+		codec.WriteMessage(&wire.Reject{Reason: "host identity not confirmed by client"})
+		return nil, fmt.Errorf("%w: host identity not confirmed", ErrRejected)
+	}
+
+	if h.known != nil {
+		if err := h.known.Remember(result.Peer); err != nil {
+			log.Printf("Warning: Could not remember host: %v\n", err)
 		}
 	}
+
+	return result, nil
+}
+
+func (h *GPGHandshake) result(s network.Stream, peerHello *wire.Hello, ownFingerprint string, encryptor Encryptor, recipientKey string) *Result {
+	return &Result{
+		Peer: Identity{
+			Name:        peerHello.UserID,
+			Fingerprint: peerHello.Fingerprint,
+			PeerID:      s.Conn().RemotePeer(),
+		},
+		RecipientKey: recipientKey,
+		Cipher: &gpgCipher{
+			Encryptor: encryptor,
+			backend:   h.backend,
+			self:      ownFingerprint,
+			peer:      peerHello.Fingerprint,
+		},
+	}
+}
+
+// gpgEncryptor encrypts to the peer's GPG key and decrypts with our own.
+type gpgEncryptor struct {
+	backend Backend
+	peer    string
+}
+
+func (e *gpgEncryptor) Encrypt(dst io.Writer, src io.Reader) error {
+	return e.backend.Encrypt(dst, src, e.peer)
+}
+
+func (e *gpgEncryptor) Decrypt(dst io.Writer, src io.Reader) error {
+	return e.backend.Decrypt(dst, src)
+}
+
+// gpgCipher verifies the peer authenticated by GPGHandshake and signs with
+// our own key. Payloads go through the encryption picked in the handshake.
+type gpgCipher struct {
+	Encryptor
+	backend Backend
+	self    string
+	peer    string
+}
+
+func (c *gpgCipher) Sign(data []byte) ([]byte, error) {
+	return c.backend.Sign(data, c.self)
+}
+
+func (c *gpgCipher) Verify(data []byte, signature []byte) error {
+	signer, err := c.backend.Verify(data, signature)
+	if err != nil {
+		return err
+	}
+	if signer != c.peer {
+		return fmt.Errorf("signed by %s, expected %s", signer, c.peer)
+	}
+	return nil
 }
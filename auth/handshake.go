@@ -1,13 +1,93 @@
 package auth
 
-import "github.com/libp2p/go-libp2p/core/network"
+import (
+	"errors"
+	"io"
+	"path"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrRejected is returned when either side declines the connection.
+var ErrRejected = errors.New("connection rejected")
+
+// Identity is the remote party as established by a handshake.
+type Identity struct {
+	Name        string
+	Fingerprint string
+	PeerID      peer.ID
+}
+
+func (i Identity) String() string {
+	if i.Fingerprint == "" || i.Fingerprint == i.Name {
+		return i.Name
+	}
+	return i.Name + " (" + i.Fingerprint + ")"
+}
+
+// Encryptor encrypts payloads for the peer and decrypts the ones the peer
+// encrypted for us.
+type Encryptor interface {
+	Encrypt(dst io.Writer, src io.Reader) error
+	Decrypt(dst io.Writer, src io.Reader) error
+}
+
+// Ways to encrypt payloads. A GPG handshake picks one per session from
+// those the client supports.
+const (
+	EncryptionGPG = "gpg"
+	EncryptionAge = "age"
+)
+
+// Cipher performs the payload cryptography agreed on during a handshake:
+// Encrypt and Verify act on behalf of the peer, Decrypt and Sign use our own
+// keys.
+type Cipher interface {
+	Encryptor
+	Sign(data []byte) ([]byte, error)
+	Verify(data []byte, signature []byte) error
+}
+
+// Result is what a successful handshake yields.
+type Result struct {
+	Peer         Identity // who is on the other end of the stream
+	RecipientKey string   // the key the payload gets encrypted to
+	Cipher       Cipher
+	Files        []string // patterns of the files the peer may get, nil for all
+	SessionOnly  bool     // RecipientKey dies with the stream, so nothing can be resumed
+}
+
+// Allows reports whether the peer may get the file with the given name.
+func (r *Result) Allows(name string) bool {
+	if r.Files == nil {
+		return true
+	}
+	for _, pattern := range r.Files {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Handshake modes, picked with -auth.
+const (
+	ModeGPG  = "gpg"
+	ModeSSH  = "ssh"
+	ModePAKE = "pake"
+)
 
 type Handshaker interface {
-	Handshake(network.Stream) bool
+	Handshake(network.Stream) (*Result, error)
 }
 
+// NOOPHandshake accepts every peer without authenticating it. It negotiates
+// no Cipher, so it can't be used to transfer files.
 type NOOPHandshake struct{}
 
-func (h *NOOPHandshake) Handshake(_ network.Stream) bool {
-	return true
+func (h *NOOPHandshake) Handshake(s network.Stream) (*Result, error) {
+	return &Result{
+		Peer: Identity{PeerID: s.Conn().RemotePeer()},
+	}, nil
 }
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Keyring is a throwaway GPG home directory holding the public keys of the
+// peers we talk to. It keeps stranger keys out of the user's own keyring and
+// is wiped by Close. Keys imported here are not trusted for encryption until
+// Trust is called for them.
+type Keyring struct {
+	dir string
+}
+
+func NewKeyring() (*Keyring, error) {
+	dir, err := os.MkdirTemp("", "secretshare-gpg-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary GPG home: %w", err)
+	}
+
+	if err := os.Chmod(dir, 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to secure temporary GPG home: %w", err)
+	}
+
+	return &Keyring{dir: dir}, nil
+}
+
+func (k *Keyring) command(args ...string) *exec.Cmd {
+	return exec.Command("gpg", append([]string{"--homedir", k.dir, "--batch", "--no-autostart"}, args...)...)
+}
+
+// Import adds an armored public key block to the keyring and returns the
+// fingerprints of the keys GPG actually imported.
+func (k *Keyring) Import(publicKey []byte) ([]string, error) {
+	cmd := k.command("--status-fd", "1", "--import")
+	cmd.Stdin = bytes.NewReader(publicKey)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to import public key: %v\nStderr: %s", err, stderr.String())
+	}
+
+	// [GNUPG:] IMPORT_OK <reason> <fingerprint>
+	var fingerprints []string
+	lines := bytes.Split(stdout.Bytes(), []byte("\n"))
+	for _, line := range lines {
+		fields := strings.Fields(string(line))
+		if len(fields) >= 4 && fields[0] == "[GNUPG:]" && fields[1] == "IMPORT_OK" {
+			fingerprints = append(fingerprints, fields[3])
+		}
+	}
+
+	return fingerprints, nil
+}
+
+// UserIDs returns the valid user IDs on an imported key. Unlike a user ID
+// a peer claims, these are bound to the key by its self-signatures.
+func (k *Keyring) UserIDs(fingerprint string) ([]string, error) {
+	cmd := k.command("--with-colons", "--list-keys", fingerprint)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to list user IDs of %s: %v\nStderr: %s", fingerprint, err, stderr.String())
+	}
+
+	// Revoked (r) and expired (e) user IDs are left out.
+	var userIDs []string
+	lines := bytes.Split(stdout.Bytes(), []byte("\n"))
+	for _, line := range lines {
+		fields := strings.Split(string(line), ":")
+		if len(fields) >= 10 && fields[0] == "uid" && fields[1] != "r" && fields[1] != "e" {
+			userIDs = append(userIDs, unescapeColons(fields[9]))
+		}
+	}
+
+	return userIDs, nil
+}
+
+// Trust marks the key as one we are willing to encrypt to. Call it only after
+// the user approved the peer.
+func (k *Keyring) Trust(fingerprint string) error {
+	cmd := k.command("--import-ownertrust")
+	cmd.Stdin = strings.NewReader(fingerprint + ":5:\n")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to trust key %s: %v\nStderr: %s", fingerprint, err, stderr.String())
+	}
+
+	return nil
+}
+
+// Verify checks a detached signature over data against the keys in the
+// keyring and returns the fingerprint of the primary key that made it.
+func (k *Keyring) Verify(data []byte, signature []byte) (string, error) {
+	sigFile, err := os.CreateTemp(k.dir, "sig-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create signature file: %w", err)
+	}
+	defer os.Remove(sigFile.Name())
+
+	_, err = sigFile.Write(signature)
+	if closeErr := sigFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write signature file: %w", err)
+	}
+
+	cmd := k.command("--status-fd", "1", "--verify", sigFile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(data)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("GPG signature verification failed: %v\nStderr: %s", err, stderr.String())
+	}
+
+	// [GNUPG:] VALIDSIG <fpr> <date> <timestamp> <expire> <version> <reserved> <pk-algo> <hash-algo> <class> <primary-fpr>
+	lines := bytes.Split(stdout.Bytes(), []byte("\n"))
+	for _, line := range lines {
+		fields := strings.Fields(string(line))
+		if len(fields) >= 12 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			return fields[11], nil
+		}
+	}
+
+	return "", fmt.Errorf("GPG reported no valid signature")
+}
+
+// Encrypt pipes src through gpg and writes the ciphertext to dst as gpg
+// produces it, so memory use doesn't grow with the input size. The
+// recipient must have been trusted with Trust first.
+func (k *Keyring) Encrypt(dst io.Writer, src io.Reader, recipientFingerprint string) error {
+	cmd := k.command("--trust-model", "direct", "--encrypt", "--recipient", recipientFingerprint)
+	cmd.Stdin = src
+	cmd.Stdout = dst
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("GPG encryption failed: %v\nStderr: %s", err, stderr.String())
+	}
+
+	return nil
+}
+
+// Close stops any GPG daemons started for the keyring and deletes it.
+func (k *Keyring) Close() error {
+	exec.Command("gpgconf", "--homedir", k.dir, "--kill", "all").Run()
+	return os.RemoveAll(k.dir)
+}
@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ErrPeerChanged is returned when a peer doesn't match what was seen before
+// and such peers are refused.
+var ErrPeerChanged = errors.New("peer does not match known_peers")
+
+// KnownPeer pairs a GPG key with the peer ID it was seen at, like an entry
+// in ssh's known_hosts.
+type KnownPeer struct {
+	Fingerprint string
+	PeerID      peer.ID
+	Name        string
+	Added       time.Time
+}
+
+// KnownPeers remembers the hosts we trusted, so a later connection can be
+// checked against them. It is stored as one peer per line: fingerprint,
+// peer ID, the date it was added and the GPG user ID.
+type KnownPeers struct {
+	Strict bool // refuse peers that don't match instead of warning
+
+	path  string
+	peers []KnownPeer
+}
+
+// LoadKnownPeers reads the file at path. A missing file is empty.
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	k := &KnownPeers{path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s:%d: expected fingerprint, peer ID, date and name", path, lineNo)
+		}
+
+		id, err := peer.Decode(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		added, err := time.Parse(time.DateOnly, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+
+		k.peers = append(k.peers, KnownPeer{
+			Fingerprint: fields[0],
+			PeerID:      id,
+			Added:       added,
+			Name:        fields[3],
+		})
+	}
+
+	return k, scanner.Err()
+}
+
+// Peers returns every known peer.
+func (k *KnownPeers) Peers() []KnownPeer {
+	return k.peers
+}
+
+// Lookup returns the peer known under the peer ID.
+func (k *KnownPeers) Lookup(id peer.ID) (KnownPeer, bool) {
+	for _, p := range k.peers {
+		if p.PeerID == id {
+			return p, true
+		}
+	}
+	return KnownPeer{}, false
+}
+
+// Check compares the identity with the known peers. It returns a note for
+// the user, which carries a warning for every mismatch. In strict mode a
+// mismatch is an error wrapping ErrPeerChanged instead.
+func (k *KnownPeers) Check(id Identity) (string, error) {
+	var warnings []string
+	for _, p := range k.peers {
+		switch {
+		case p.Fingerprint == id.Fingerprint && p.PeerID == id.PeerID:
+			return fmt.Sprintf("Known peer since %s.", p.Added.Format(time.DateOnly)), nil
+		case p.Fingerprint == id.Fingerprint:
+			warnings = append(warnings, fmt.Sprintf("Key %s was last seen at peer ID %s, not %s. Unless the host has no persistent identity, someone may be pretending to be them.", id.Fingerprint, p.PeerID, id.PeerID))
+		case p.PeerID == id.PeerID:
+			warnings = append(warnings, fmt.Sprintf("Peer ID %s belonged to %s (%s) before. Someone else may be using their address.", id.PeerID, p.Name, p.Fingerprint))
+		case p.Name == id.Name:
+			warnings = append(warnings, fmt.Sprintf("%s used key %s before. Someone may have made a key with their name.", p.Name, p.Fingerprint))
+		}
+	}
+
+	if len(warnings) == 0 {
+		return fmt.Sprintf("New peer, it will be remembered in %s.", k.path), nil
+	}
+	if k.Strict {
+		return "", fmt.Errorf("%w: %s", ErrPeerChanged, warnings[0])
+	}
+	return "WARNING: " + strings.Join(warnings, "\nWARNING: "), nil
+}
+
+// Remember stores the identity, replacing the peers it conflicted with.
+func (k *KnownPeers) Remember(id Identity) error {
+	kept := k.peers[:0]
+	for _, p := range k.peers {
+		if p.Fingerprint == id.Fingerprint && p.PeerID == id.PeerID {
+			return nil
+		}
+		if p.Fingerprint != id.Fingerprint && p.PeerID != id.PeerID && p.Name != id.Name {
+			kept = append(kept, p)
+		}
+	}
+
+	k.peers = append(kept, KnownPeer{
+		Fingerprint: id.Fingerprint,
+		PeerID:      id.PeerID,
+		// The name comes from the peer, a line break in it would add a
+		// line of its own to the file.
+		Name:  strings.Map(flattenLineBreak, id.Name),
+		Added: time.Now(),
+	})
+	return k.save()
+}
+
+func flattenLineBreak(r rune) rune {
+	if r == '\n' || r == '\r' {
+		return ' '
+	}
+	return r
+}
+
+// Forget removes the peers whose fingerprint, peer ID or name is query and
+// returns how many there were.
+func (k *KnownPeers) Forget(query string) (int, error) {
+	kept := k.peers[:0]
+	for _, p := range k.peers {
+		if p.Fingerprint != query && p.PeerID.String() != query && p.Name != query {
+			kept = append(kept, p)
+		}
+	}
+
+	removed := len(k.peers) - len(kept)
+	k.peers = kept
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, k.save()
+}
+
+func (k *KnownPeers) save() error {
+	var b strings.Builder
+	b.WriteString("# fingerprint peer-id added name\n")
+	for _, p := range k.peers {
+		// The name goes last, it is the only field that may hold spaces.
+		fmt.Fprintf(&b, "%s %s %s %s\n", p.Fingerprint, p.PeerID, p.Added.Format(time.DateOnly), p.Name)
+	}
+
+	dir := filepath.Dir(k.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".known_peers-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(b.String())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", k.path, err)
+	}
+
+	return os.Rename(tmp.Name(), k.path)
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func newTestPeerID(t *testing.T) peer.ID {
+	t.Helper()
+
+	_, public, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func loadKnownPeers(t *testing.T, path string) *KnownPeers {
+	t.Helper()
+
+	k, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKnownPeersRemember(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secretshare", "known_peers")
+	k := loadKnownPeers(t, path)
+	if len(k.Peers()) != 0 {
+		t.Fatal("a missing file has peers")
+	}
+
+	alice := Identity{Name: "Alice <alice@example.org>", Fingerprint: "AAAA", PeerID: newTestPeerID(t)}
+	note, err := k.Check(alice)
+	if err != nil || !strings.HasPrefix(note, "New peer") {
+		t.Fatalf("first Check = %q, %v", note, err)
+	}
+	if err := k.Remember(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Remember(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	k = loadKnownPeers(t, path)
+	if peers := k.Peers(); len(peers) != 1 || peers[0].Name != alice.Name || peers[0].Fingerprint != alice.Fingerprint || peers[0].PeerID != alice.PeerID {
+		t.Fatalf("reloaded %+v", peers)
+	}
+	if known, ok := k.Lookup(alice.PeerID); !ok || known.Name != alice.Name {
+		t.Fatalf("Lookup = %+v, %v", known, ok)
+	}
+	note, err = k.Check(alice)
+	if err != nil || !strings.HasPrefix(note, "Known peer since") {
+		t.Fatalf("Check after reload = %q, %v", note, err)
+	}
+}
+
+func TestKnownPeersRefuseChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	k := loadKnownPeers(t, path)
+	k.Strict = true
+
+	alice := Identity{Name: "Alice <alice@example.org>", Fingerprint: "AAAA", PeerID: newTestPeerID(t)}
+	if err := k.Remember(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := map[string]Identity{
+		"new key for a known name":  {Name: alice.Name, Fingerprint: "BBBB", PeerID: newTestPeerID(t)},
+		"known key at a new peer":   {Name: alice.Name, Fingerprint: alice.Fingerprint, PeerID: newTestPeerID(t)},
+		"known peer with a new key": {Name: "Mallory", Fingerprint: "BBBB", PeerID: alice.PeerID},
+	}
+	for name, id := range changed {
+		if _, err := k.Check(id); !errors.Is(err, ErrPeerChanged) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrPeerChanged)
+		}
+
+		k.Strict = false
+		note, err := k.Check(id)
+		if err != nil || !strings.HasPrefix(note, "WARNING: ") {
+			t.Errorf("%s: not strict, Check = %q, %v", name, note, err)
+		}
+		k.Strict = true
+	}
+
+	bob := Identity{Name: "Bob", Fingerprint: "CCCC", PeerID: newTestPeerID(t)}
+	if _, err := k.Check(bob); err != nil {
+		t.Fatalf("an unrelated peer was refused: %v", err)
+	}
+}
+
+func TestKnownPeersForgetAllowsRepinning(t *testing.T) {
+	alice := Identity{Name: "Alice", Fingerprint: "AAAA", PeerID: newTestPeerID(t)}
+	bob := Identity{Name: "Bob", Fingerprint: "BBBB", PeerID: newTestPeerID(t)}
+	newAlice := Identity{Name: "Alice", Fingerprint: "DDDD", PeerID: newTestPeerID(t)}
+
+	for _, query := range []string{"Alice", "AAAA", alice.PeerID.String()} {
+		path := filepath.Join(t.TempDir(), "known_peers")
+		k := loadKnownPeers(t, path)
+		k.Strict = true
+		for _, id := range []Identity{alice, bob} {
+			if err := k.Remember(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := k.Check(newAlice); !errors.Is(err, ErrPeerChanged) {
+			t.Fatalf("changed key: got %v, want %v", err, ErrPeerChanged)
+		}
+
+		if n, err := k.Forget("nobody"); err != nil || n != 0 {
+			t.Fatalf("Forget(nobody) = %d, %v", n, err)
+		}
+		if n, err := k.Forget(query); err != nil || n != 1 {
+			t.Fatalf("Forget(%s) = %d, %v", query, n, err)
+		}
+
+		k = loadKnownPeers(t, path)
+		k.Strict = true
+		if _, err := k.Check(newAlice); err != nil {
+			t.Fatalf("forgotten by %s, still refused: %v", query, err)
+		}
+		if err := k.Remember(newAlice); err != nil {
+			t.Fatal(err)
+		}
+
+		k = loadKnownPeers(t, path)
+		if known, ok := k.Lookup(newAlice.PeerID); !ok || known.Fingerprint != newAlice.Fingerprint {
+			t.Fatalf("new key not pinned: %+v, %v", known, ok)
+		}
+		if _, ok := k.Lookup(bob.PeerID); !ok {
+			t.Fatalf("Forget(%s) removed a peer that didn't match", query)
+		}
+	}
+}
+
+func TestKnownPeersNameCannotAddLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_peers")
+	k := loadKnownPeers(t, path)
+
+	injected := "BBBB " + newTestPeerID(t).String() + " 2020-01-01 Bob"
+	mallory := Identity{Name: "Mallory\n" + injected, Fingerprint: "AAAA", PeerID: newTestPeerID(t)}
+	if err := k.Remember(mallory); err != nil {
+		t.Fatal(err)
+	}
+
+	if peers := loadKnownPeers(t, path).Peers(); len(peers) != 1 || peers[0].Name != "Mallory "+injected {
+		t.Fatalf("reloaded %+v", peers)
+	}
+}
+
+func TestLoadKnownPeersRefusesMalformedLines(t *testing.T) {
+	id := newTestPeerID(t).String()
+	for _, line := range []string{
+		"AAAA " + id + " 2020-01-01",
+		"AAAA not-a-peer-id 2020-01-01 Alice",
+		"AAAA " + id + " yesterday Alice",
+	} {
+		path := filepath.Join(t.TempDir(), "known_peers")
+		if err := os.WriteFile(path, []byte("# comment\n\n"+line+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKnownPeers(path); err == nil || !strings.Contains(err.Error(), ":3:") {
+			t.Errorf("%q: got %v, want an error on line 3", line, err)
+		}
+	}
+}
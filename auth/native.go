@@ -0,0 +1,379 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// PassphraseEnv names the environment variable the native backend reads the
+// passphrase for protected secret keys from.
+const PassphraseEnv = "SECRETSHARE_PGP_PASSPHRASE"
+
+// NativeBackend implements Backend in Go, so no gpg binary is needed. Secret
+// keys are loaded once from disk, peer keys are kept in memory only.
+type NativeBackend struct {
+	secret openpgp.EntityList
+
+	mu      sync.Mutex
+	peers   openpgp.EntityList
+	trusted map[string]bool
+}
+
+// NewNativeBackend loads secret keys from keyPath, which is either a key file
+// (armored or binary) or a directory whose files are all read.
+func NewNativeBackend(keyPath string) (*NativeBackend, error) {
+	if keyPath == "" {
+		return nil, errors.New("the native OpenPGP backend needs a key file or directory (-pgp-keys)")
+	}
+
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key path: %w", err)
+	}
+
+	files := []string{keyPath}
+	if info.IsDir() {
+		entries, err := os.ReadDir(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key directory: %w", err)
+		}
+
+		files = files[:0]
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				files = append(files, filepath.Join(keyPath, entry.Name()))
+			}
+		}
+	}
+
+	var secret openpgp.EntityList
+	for _, file := range files {
+		entities, err := readKeyFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys from %s: %w", file, err)
+		}
+
+		for _, e := range entities {
+			if e.PrivateKey == nil {
+				continue
+			}
+			if err := unlockEntity(e); err != nil {
+				return nil, fmt.Errorf("failed to unlock key %s: %w", entityFingerprint(e), err)
+			}
+			secret = append(secret, e)
+		}
+	}
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("no secret keys found in %s", keyPath)
+	}
+
+	return &NativeBackend{
+		secret:  secret,
+		trusted: make(map[string]bool),
+	}, nil
+}
+
+func readKeyFile(path string) (openpgp.EntityList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err == nil {
+		return entities, nil
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(data))
+}
+
+func unlockEntity(e *openpgp.Entity) error {
+	if !e.PrivateKey.Encrypted {
+		return nil
+	}
+
+	passphrase := os.Getenv(PassphraseEnv)
+	if passphrase == "" {
+		return fmt.Errorf("key is passphrase protected, set %s", PassphraseEnv)
+	}
+
+	return e.DecryptPrivateKeys([]byte(passphrase))
+}
+
+func entityFingerprint(e *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint))
+}
+
+func findEntity(entities openpgp.EntityList, fingerprint string) *openpgp.Entity {
+	for _, e := range entities {
+		if entityFingerprint(e) == fingerprint {
+			return e
+		}
+	}
+	return nil
+}
+
+func (b *NativeBackend) ListSecretKeys() ([]Key, error) {
+	keys := make([]Key, 0, len(b.secret))
+	for _, e := range b.secret {
+		key := Key{Fingerprint: entityFingerprint(e)}
+		if id := e.PrimaryIdentity(); id != nil {
+			key.UserID = id.Name
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (b *NativeBackend) Export(fingerprint string) ([]byte, error) {
+	e := findEntity(b.secret, fingerprint)
+	if e == nil {
+		return nil, fmt.Errorf("failed to export public key: no secret key %s", fingerprint)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.Serialize(w); err != nil {
+		return nil, fmt.Errorf("failed to export public key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (b *NativeBackend) Import(publicKey []byte) ([]string, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(publicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to import public key: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Encrypt and Verify may still use the old list, so change a copy.
+	peers := slices.Clone(b.peers)
+
+	var fingerprints []string
+	for _, e := range entities {
+		// Never keep secret material a peer might have sent along.
+		e.PrivateKey = nil
+		for i := range e.Subkeys {
+			e.Subkeys[i].PrivateKey = nil
+		}
+
+		fingerprint := entityFingerprint(e)
+		if i := slices.IndexFunc(peers, func(known *openpgp.Entity) bool {
+			return entityFingerprint(known) == fingerprint
+		}); i >= 0 {
+			peers[i] = mergeEntity(peers[i], e)
+		} else {
+			peers = append(peers, e)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	b.peers = peers
+
+	return fingerprints, nil
+}
+
+// mergeEntity combines two copies of the same key like gpg does on import:
+// revocations from either copy are kept and newer self-signatures win, so
+// re-sending an old copy can't undo a revocation or an expiry. Neither copy
+// is modified.
+func mergeEntity(known, imported *openpgp.Entity) *openpgp.Entity {
+	merged := *known
+	merged.Revocations = mergeSignatures(known.Revocations, imported.Revocations)
+	if newerSignature(imported.SelfSignature, known.SelfSignature) {
+		merged.SelfSignature = imported.SelfSignature
+	}
+
+	merged.Identities = make(map[string]*openpgp.Identity, len(known.Identities))
+	for name, id := range known.Identities {
+		merged.Identities[name] = id
+	}
+	for name, id := range imported.Identities {
+		knownID, ok := merged.Identities[name]
+		if !ok {
+			merged.Identities[name] = id
+			continue
+		}
+
+		mergedID := *knownID
+		if newerSignature(id.SelfSignature, knownID.SelfSignature) {
+			mergedID = *id
+		}
+		mergedID.Revocations = mergeSignatures(knownID.Revocations, id.Revocations)
+		merged.Identities[name] = &mergedID
+	}
+
+	merged.Subkeys = slices.Clone(known.Subkeys)
+	for _, subkey := range imported.Subkeys {
+		i := slices.IndexFunc(merged.Subkeys, func(s openpgp.Subkey) bool {
+			return bytes.Equal(s.PublicKey.Fingerprint, subkey.PublicKey.Fingerprint)
+		})
+		if i < 0 {
+			merged.Subkeys = append(merged.Subkeys, subkey)
+			continue
+		}
+
+		knownSubkey := merged.Subkeys[i]
+		if newerSignature(subkey.Sig, knownSubkey.Sig) {
+			merged.Subkeys[i].Sig = subkey.Sig
+		}
+		merged.Subkeys[i].Revocations = mergeSignatures(knownSubkey.Revocations, subkey.Revocations)
+	}
+
+	return &merged
+}
+
+func newerSignature(sig, than *packet.Signature) bool {
+	return sig != nil && (than == nil || sig.CreationTime.After(than.CreationTime))
+}
+
+// mergeSignatures returns all signatures in a and b, without duplicates.
+func mergeSignatures(a, b []*packet.Signature) []*packet.Signature {
+	merged := slices.Clone(a)
+	for _, sig := range b {
+		if !slices.ContainsFunc(merged, func(have *packet.Signature) bool {
+			return have.SigType == sig.SigType && have.CreationTime.Equal(sig.CreationTime) &&
+				bytes.Equal(have.IssuerFingerprint, sig.IssuerFingerprint)
+		}) {
+			merged = append(merged, sig)
+		}
+	}
+	return merged
+}
+
+func (b *NativeBackend) UserIDs(fingerprint string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := findEntity(b.peers, fingerprint)
+	if e == nil {
+		return nil, fmt.Errorf("failed to list user IDs of %s: not imported", fingerprint)
+	}
+
+	var userIDs []string
+	now := time.Now()
+	for name, id := range e.Identities {
+		if id.Revoked(now) || id.SelfSignature == nil || id.SelfSignature.SigExpired(now) {
+			continue
+		}
+		userIDs = append(userIDs, name)
+	}
+	slices.Sort(userIDs)
+
+	return userIDs, nil
+}
+
+func (b *NativeBackend) Trust(fingerprint string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if findEntity(b.peers, fingerprint) == nil {
+		return fmt.Errorf("failed to trust key %s: not imported", fingerprint)
+	}
+
+	b.trusted[fingerprint] = true
+	return nil
+}
+
+func (b *NativeBackend) Encrypt(dst io.Writer, src io.Reader, recipientFingerprint string) error {
+	b.mu.Lock()
+	recipient := findEntity(b.peers, recipientFingerprint)
+	trusted := b.trusted[recipientFingerprint]
+	b.mu.Unlock()
+
+	if recipient == nil || !trusted {
+		return fmt.Errorf("OpenPGP encryption failed: recipient %s is not trusted", recipientFingerprint)
+	}
+
+	w, err := openpgp.Encrypt(dst, []*openpgp.Entity{recipient}, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return fmt.Errorf("OpenPGP encryption failed: %w", err)
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return fmt.Errorf("OpenPGP encryption failed: %w", err)
+	}
+
+	return w.Close()
+}
+
+func (b *NativeBackend) Decrypt(dst io.Writer, src io.Reader) error {
+	md, err := openpgp.ReadMessage(src, b.secret, nil, nil)
+	if err != nil {
+		return fmt.Errorf("OpenPGP decryption failed: %w", err)
+	}
+
+	if !md.IsEncrypted {
+		return errors.New("OpenPGP decryption failed: message is not encrypted")
+	}
+
+	// Integrity errors surface when the body is read to the end.
+	if _, err := io.Copy(dst, md.UnverifiedBody); err != nil {
+		return fmt.Errorf("OpenPGP decryption failed: %w", err)
+	}
+
+	return nil
+}
+
+func (b *NativeBackend) Sign(data []byte, signerFingerprint string) ([]byte, error) {
+	signer := findEntity(b.secret, signerFingerprint)
+	if signer == nil {
+		return nil, fmt.Errorf("OpenPGP signing failed: no secret key %s", signerFingerprint)
+	}
+
+	var buf bytes.Buffer
+	if err := openpgp.DetachSign(&buf, signer, bytes.NewReader(data), nil); err != nil {
+		return nil, fmt.Errorf("OpenPGP signing failed: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (b *NativeBackend) Verify(data []byte, signature []byte) (string, error) {
+	b.mu.Lock()
+	peers := b.peers
+	b.mu.Unlock()
+
+	signer, err := openpgp.CheckDetachedSignature(peers, bytes.NewReader(data), bytes.NewReader(signature), nil)
+	if err != nil {
+		return "", fmt.Errorf("OpenPGP signature verification failed: %w", err)
+	}
+
+	return entityFingerprint(signer), nil
+}
+
+func (b *NativeBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.peers = nil
+	b.trusted = make(map[string]bool)
+	return nil
+}
+
+var (
+	_ Backend = (*NativeBackend)(nil)
+	_ Backend = (*GPGBackend)(nil)
+)
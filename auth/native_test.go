@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// armoredKey returns e as the armored block a peer would send, with its
+// secret keys if private is set.
+func armoredKey(t *testing.T, e *openpgp.Entity, private bool) []byte {
+	t.Helper()
+
+	blockType := openpgp.PublicKeyType
+	if private {
+		blockType = openpgp.PrivateKeyType
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, blockType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if private {
+		err = e.SerializePrivateWithoutSigning(w, nil)
+	} else {
+		err = e.Serialize(w)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func revokeUserID(t *testing.T, e *openpgp.Entity, name string) {
+	t.Helper()
+
+	sig := &packet.Signature{
+		Version:           e.PrimaryKey.Version,
+		SigType:           packet.SigTypeCertificationRevocation,
+		PubKeyAlgo:        e.PrimaryKey.PubKeyAlgo,
+		Hash:              (&packet.Config{}).Hash(),
+		CreationTime:      time.Now(),
+		IssuerKeyId:       &e.PrimaryKey.KeyId,
+		IssuerFingerprint: e.PrimaryKey.Fingerprint,
+	}
+	if err := sig.SignUserId(name, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	id := e.Identities[name]
+	id.Revocations = append(id.Revocations, sig)
+	id.Signatures = append(id.Signatures, sig)
+}
+
+func importKey(t *testing.T, b *NativeBackend, publicKey []byte) string {
+	t.Helper()
+
+	fingerprints, err := b.Import(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 1 {
+		t.Fatalf("imported %d keys, want 1", len(fingerprints))
+	}
+	return fingerprints[0]
+}
+
+func userIDs(t *testing.T, b *NativeBackend, fingerprint string) string {
+	t.Helper()
+
+	ids, err := b.UserIDs(fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(ids, ", ")
+}
+
+func TestNativeBackendRoundTrip(t *testing.T) {
+	host, hostFingerprint := newTestBackend(t, "Host", "host@example.org")
+	client, _ := newTestBackend(t, "Client", "client@example.org")
+
+	publicKey, err := host.Export(hostFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := importKey(t, client, publicKey); got != hostFingerprint {
+		t.Fatalf("imported %s, want %s", got, hostFingerprint)
+	}
+
+	plaintext := []byte("API_KEY=secret\n")
+	var ciphertext bytes.Buffer
+	if err := client.Encrypt(&ciphertext, bytes.NewReader(plaintext), hostFingerprint); err == nil {
+		t.Fatal("encrypted to a key that is not trusted")
+	}
+	if err := client.Trust(hostFingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Encrypt(&ciphertext, bytes.NewReader(plaintext), hostFingerprint); err != nil {
+		t.Fatal(err)
+	}
+
+	var decrypted bytes.Buffer
+	if err := host.Decrypt(&decrypted, bytes.NewReader(ciphertext.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Fatalf("decrypted %q, want %q", decrypted.Bytes(), plaintext)
+	}
+	if err := client.Decrypt(&decrypted, bytes.NewReader(ciphertext.Bytes())); err == nil {
+		t.Fatal("decrypted a message for someone else")
+	}
+
+	signature, err := host.Sign(plaintext, hostFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := client.Verify(plaintext, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer != hostFingerprint {
+		t.Fatalf("signed by %s, want %s", signer, hostFingerprint)
+	}
+	if _, err := client.Verify([]byte("API_KEY=other\n"), signature); err == nil {
+		t.Fatal("verified a signature over other data")
+	}
+}
+
+func TestNativeBackendLoadsProtectedKeys(t *testing.T) {
+	e, err := openpgp.NewEntity("Host", "", "host@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncryptPrivateKeys([]byte("hunter2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "host.asc")
+	if err := os.WriteFile(keyPath, armoredKey(t, e, true), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(PassphraseEnv, "")
+	if _, err := NewNativeBackend(keyPath); err == nil {
+		t.Fatal("loaded a protected key without a passphrase")
+	}
+	t.Setenv(PassphraseEnv, "wrong")
+	if _, err := NewNativeBackend(keyPath); err == nil {
+		t.Fatal("loaded a protected key with the wrong passphrase")
+	}
+
+	t.Setenv(PassphraseEnv, "hunter2")
+	b, err := NewNativeBackend(filepath.Dir(keyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := b.ListSecretKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Fingerprint != entityFingerprint(e) || keys[0].UserID != "Host <host@example.org>" {
+		t.Fatalf("loaded %+v", keys)
+	}
+}
+
+func TestNativeBackendImportDropsSecretKeys(t *testing.T) {
+	b, _ := newTestBackend(t, "Client", "client@example.org")
+	peer, _ := newTestBackend(t, "Peer", "peer@example.org")
+
+	fingerprint := importKey(t, b, armoredKey(t, peer.secret[0], true))
+
+	e := findEntity(b.peers, fingerprint)
+	if e.PrivateKey != nil {
+		t.Fatal("kept the primary secret key of a peer")
+	}
+	for _, subkey := range e.Subkeys {
+		if subkey.PrivateKey != nil {
+			t.Fatal("kept a secret subkey of a peer")
+		}
+	}
+}
+
+func TestNativeBackendImportMergesCopies(t *testing.T) {
+	b, _ := newTestBackend(t, "Client", "client@example.org")
+	peer, _ := newTestBackend(t, "Peer", "peer@example.org")
+	e := peer.secret[0]
+
+	if err := e.AddUserId("Peer", "", "peer@work.example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	old := armoredKey(t, e, false)
+
+	revokeUserID(t, e, "Peer <peer@work.example.org>")
+	if err := e.AddUserId("Peer", "", "peer@new.example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	revoked := armoredKey(t, e, false)
+
+	fingerprint := importKey(t, b, old)
+	if got, want := userIDs(t, b, fingerprint), "Peer <peer@example.org>, Peer <peer@work.example.org>"; got != want {
+		t.Fatalf("user IDs %q, want %q", got, want)
+	}
+
+	importKey(t, b, revoked)
+	if got, want := userIDs(t, b, fingerprint), "Peer <peer@example.org>, Peer <peer@new.example.org>"; got != want {
+		t.Fatalf("user IDs after importing a newer copy %q, want %q", got, want)
+	}
+
+	// The revocation has to survive a peer sending the old copy again.
+	importKey(t, b, old)
+	if got, want := userIDs(t, b, fingerprint), "Peer <peer@example.org>, Peer <peer@new.example.org>"; got != want {
+		t.Fatalf("user IDs after importing the old copy again %q, want %q", got, want)
+	}
+	if n := len(b.peers); n != 1 {
+		t.Fatalf("keeping %d copies of one key", n)
+	}
+}
+
+func TestNativeBackendUserIDsSkipsExpired(t *testing.T) {
+	b, _ := newTestBackend(t, "Client", "client@example.org")
+	peer, _ := newTestBackend(t, "Peer", "peer@example.org")
+	e := peer.secret[0]
+
+	expired := &packet.Config{
+		Time:            func() time.Time { return time.Now().Add(-2 * time.Hour) },
+		SigLifetimeSecs: 3600,
+	}
+	if err := e.AddUserId("Peer", "", "peer@old.example.org", expired); err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := importKey(t, b, armoredKey(t, e, false))
+	ids, err := b.UserIDs(fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []string{"Peer <peer@example.org>"}) {
+		t.Fatalf("user IDs %q, want only the unexpired one", ids)
+	}
+
+	if _, err := b.UserIDs("0000"); err == nil {
+		t.Fatal("listed user IDs of a key that was never imported")
+	}
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+	"github.com/gtank/ristretto255"
+	"github.com/libp2p/go-libp2p/core/network"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PasswordEnv names the environment variable the password of a PAKE
+// handshake is read from, instead of asking for it.
+const PasswordEnv = "SECRETSHARE_PASSWORD"
+
+// maxPasswordFailures is how many wrong passwords the host takes before it
+// refuses every further attempt. A short password, like a pairing code,
+// could be guessed online otherwise.
+const maxPasswordFailures = 3
+
+var (
+	// ErrWrongPassword is returned when the peer proves it used another
+	// password.
+	ErrWrongPassword = errors.New("wrong password")
+
+	errPasswordLocked = errors.New("too many wrong passwords")
+)
+
+// PAKEHandshake authenticates both sides with a short shared password
+// instead of GPG keys, using CPace over ristretto255. Someone listening in,
+// or pretending to be the other side, learns nothing that lets them test
+// guesses offline: each attempt is a single guess. The exchange is bound to
+// the protocol and both libp2p peer IDs, like the GPG challenge.
+type PAKEHandshake struct {
+	isHost   bool
+	password []byte
+
+	mu       sync.Mutex
+	failures int
+}
+
+func NewPAKEHandshake(isHost bool, password []byte) *PAKEHandshake {
+	return &PAKEHandshake{
+		isHost:   isHost,
+		password: password,
+	}
+}
+
+// peerWithPassword names the other side, which is only known by the
+// password it proved.
+const peerWithPassword = "peer with the password"
+
+func (h *PAKEHandshake) Handshake(s network.Stream) (*Result, error) {
+	codec := wire.NewCodec(s)
+
+	clientPeer, hostPeer := s.Conn().LocalPeer(), s.Conn().RemotePeer()
+	if h.isHost {
+		clientPeer, hostPeer = hostPeer, clientPeer
+	}
+	sid := transcript([]byte("secretshare-pake"), []byte(s.Protocol()), []byte(clientPeer), []byte(hostPeer))
+
+	exchange, err := newCPace(h.password, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys *sessionKeys
+	if h.isHost {
+		keys, err = h.hostHandshake(codec, exchange)
+	} else {
+		keys, err = h.clientHandshake(codec, exchange)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Peer:         Identity{Name: peerWithPassword, PeerID: s.Conn().RemotePeer()},
+		RecipientKey: keys.id(),
+		Cipher:       keys.cipher(h.isHost),
+		SessionOnly:  true,
+	}, nil
+}
+
+func (h *PAKEHandshake) hostHandshake(codec *wire.Codec, exchange *cpace) (*sessionKeys, error) {
+	clientShare, err := wire.Expect[*wire.Pake](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key exchange from client: %w", err)
+	}
+
+	if h.locked() {
+		codec.WriteMessage(&wire.Error{Message: "too many wrong passwords, ask the host to share again"})
+		return nil, errPasswordLocked
+	}
+
+	if err := codec.WriteMessage(&wire.Pake{Share: exchange.share}); err != nil {
+		return nil, fmt.Errorf("failed to send key exchange to client: %w", err)
+	}
+
+	keys, err := exchange.finish(clientShare.Share, clientShare.Share, exchange.share)
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "invalid key exchange"})
+		return nil, fmt.Errorf("invalid key exchange from client: %w", err)
+	}
+
+	proof, err := wire.Expect[*wire.Proof](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proof from client: %w", err)
+	}
+
+	if !hmac.Equal(proof.Signature, keys.confirmation(roleClient)) {
+		failures := h.fail()
+		codec.WriteMessage(&wire.Error{Message: ErrWrongPassword.Error(), Code: wire.CodeWrongPassword})
+		if failures >= maxPasswordFailures {
+			log.Printf("Warning: %d wrong passwords, refusing every further attempt\n", failures)
+		}
+		return nil, fmt.Errorf("client used a %w (attempt %d of %d)", ErrWrongPassword, failures, maxPasswordFailures)
+	}
+
+	if err := codec.WriteMessage(&wire.Proof{Signature: keys.confirmation(roleHost)}); err != nil {
+		return nil, fmt.Errorf("failed to send proof to client: %w", err)
+	}
+
+	log.Println("Client proved it knows the password")
+	return keys, nil
+}
+
+func (h *PAKEHandshake) clientHandshake(codec *wire.Codec, exchange *cpace) (*sessionKeys, error) {
+	if err := codec.WriteMessage(&wire.Pake{Share: exchange.share}); err != nil {
+		return nil, fmt.Errorf("failed to send key exchange to host: %w", err)
+	}
+
+	hostShare, err := wire.Expect[*wire.Pake](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key exchange from host: %w", err)
+	}
+
+	keys, err := exchange.finish(hostShare.Share, exchange.share, hostShare.Share)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key exchange from host: %w", err)
+	}
+
+	if err := codec.WriteMessage(&wire.Proof{Signature: keys.confirmation(roleClient)}); err != nil {
+		return nil, fmt.Errorf("failed to send proof to host: %w", err)
+	}
+
+	response, err := codec.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from host: %w", err)
+	}
+
+	switch m := response.(type) {
+	case *wire.Proof:
+		if !hmac.Equal(m.Signature, keys.confirmation(roleHost)) {
+			return nil, fmt.Errorf("host used a %w", ErrWrongPassword)
+		}
+	case *wire.Reject:
+		return nil, fmt.Errorf("%w by host: %s", ErrRejected, m.Reason)
+	case *wire.Error:
+		if m.Code == wire.CodeWrongPassword {
+			return nil, fmt.Errorf("host says we used a %w", ErrWrongPassword)
+		}
+		return nil, fmt.Errorf("handshake aborted by host: %w", m)
+	default:
+		return nil, fmt.Errorf("%w: got %s during handshake", wire.ErrUnexpectedMessage, m.Type())
+	}
+
+	log.Println("Host proved it knows the password")
+	return keys, nil
+}
+
+func (h *PAKEHandshake) locked() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures >= maxPasswordFailures
+}
+
+func (h *PAKEHandshake) fail() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures++
+	return h.failures
+}
+
+// cpace is one side of a CPace key exchange. Both sides derive the same
+// generator from the password and session ID, and swap a random multiple
+// of it.
+type cpace struct {
+	sid    []byte
+	secret *ristretto255.Scalar
+	share  []byte
+}
+
+func newCPace(password []byte, sid []byte) (*cpace, error) {
+	seed := sha512.Sum512(transcript([]byte("secretshare-cpace-generator"), password, sid))
+	generator := ristretto255.NewElement().FromUniformBytes(seed[:])
+
+	var random [64]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, err
+	}
+	secret := ristretto255.NewScalar().FromUniformBytes(random[:])
+
+	return &cpace{
+		sid:    sid,
+		secret: secret,
+		share:  ristretto255.NewElement().ScalarMult(secret, generator).Encode(nil),
+	}, nil
+}
+
+// finish combines our secret with the peer's share into the session keys.
+func (c *cpace) finish(peerShare []byte, clientShare []byte, hostShare []byte) (*sessionKeys, error) {
+	peer := ristretto255.NewElement()
+	if err := peer.Decode(peerShare); err != nil {
+		return nil, err
+	}
+
+	shared := ristretto255.NewElement().ScalarMult(c.secret, peer)
+	if shared.Equal(ristretto255.NewElement().Zero()) == 1 {
+		return nil, errors.New("key exchange share is the identity element")
+	}
+
+	isk := sha512.Sum512(transcript([]byte("secretshare-cpace-isk"), c.sid, shared.Encode(nil), clientShare, hostShare))
+	return &sessionKeys{secret: isk[:]}, nil
+}
+
+// sessionKeys derives every key of a session from the secret both sides
+// agreed on.
+type sessionKeys struct {
+	secret []byte
+}
+
+func (k *sessionKeys) derive(label string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, k.secret, nil, []byte("secretshare "+label)), key); err != nil {
+		panic(err) // 32 bytes are far below what HKDF can produce
+	}
+	return key
+}
+
+// confirmation proves that the sender in role derived the same keys, and
+// so used the same password.
+func (k *sessionKeys) confirmation(role string) []byte {
+	mac := hmac.New(sha256.New, k.derive("confirm "+role))
+	mac.Write([]byte(role))
+	return mac.Sum(nil)
+}
+
+// id names the session. Payloads encrypted for one session can't be read in
+// another, so transfers are never resumed across them.
+func (k *sessionKeys) id() string {
+	return "session:" + hex.EncodeToString(k.derive("id")[:8])
+}
+
+func (k *sessionKeys) cipher(isHost bool) *sessionCipher {
+	self, peer := roleClient, roleHost
+	if isHost {
+		self, peer = roleHost, roleClient
+	}
+	return &sessionCipher{
+		sealKey:   k.derive("payload from " + self),
+		openKey:   k.derive("payload from " + peer),
+		signKey:   k.derive("signature from " + self),
+		verifyKey: k.derive("signature from " + peer),
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+const testProtocol = "/secretshare-test/1"
+
+type handshakeResult struct {
+	result *Result
+	err    error
+}
+
+// pakePeers returns a host and a client connected over a mocknet. Every
+// stream the client opens is handshaken by hostSide.
+func pakePeers(t *testing.T, hostSide *PAKEHandshake) (host.Host, host.Host, <-chan handshakeResult) {
+	t.Helper()
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+
+	hostPeer, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPeer, err := mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan handshakeResult, 1)
+	hostPeer.SetStreamHandler(testProtocol, func(s network.Stream) {
+		result, err := hostSide.Handshake(s)
+		s.Close()
+		results <- handshakeResult{result, err}
+	})
+
+	return hostPeer, clientPeer, results
+}
+
+// pakeConnect runs the client side of a handshake and waits for the host's.
+func pakeConnect(t *testing.T, hostPeer, clientPeer host.Host, results <-chan handshakeResult, password string) (onHost, onClient handshakeResult) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := clientPeer.NewStream(ctx, hostPeer.ID(), testProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	onClient.result, onClient.err = NewPAKEHandshake(false, []byte(password)).Handshake(s)
+
+	select {
+	case onHost = <-results:
+	case <-ctx.Done():
+		t.Fatal("host never finished the handshake")
+	}
+	return onHost, onClient
+}
+
+func TestPAKESamePassword(t *testing.T) {
+	hostPeer, clientPeer, results := pakePeers(t, NewPAKEHandshake(true, []byte("7-crossbow-pilot")))
+	onHost, onClient := pakeConnect(t, hostPeer, clientPeer, results, "7-crossbow-pilot")
+	if onHost.err != nil || onClient.err != nil {
+		t.Fatalf("handshake failed: host %v, client %v", onHost.err, onClient.err)
+	}
+
+	if onHost.result.RecipientKey != onClient.result.RecipientKey {
+		t.Fatalf("sessions differ: host %s, client %s", onHost.result.RecipientKey, onClient.result.RecipientKey)
+	}
+	if onHost.result.Peer.PeerID != clientPeer.ID() || onClient.result.Peer.PeerID != hostPeer.ID() {
+		t.Fatal("handshake results name the wrong peers")
+	}
+
+	var ciphertext, plaintext bytes.Buffer
+	if err := onHost.result.Cipher.Encrypt(&ciphertext, bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := onClient.result.Cipher.Decrypt(&plaintext, &ciphertext); err != nil {
+		t.Fatalf("client can't decrypt what the host encrypted: %v", err)
+	}
+	if plaintext.String() != "secret" {
+		t.Fatalf("decrypted %q", plaintext.String())
+	}
+
+	signature, err := onHost.result.Cipher.Sign([]byte("offer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := onClient.result.Cipher.Verify([]byte("offer"), signature); err != nil {
+		t.Fatalf("client can't verify the host's signature: %v", err)
+	}
+	if err := onHost.result.Cipher.Verify([]byte("offer"), signature); err == nil {
+		t.Fatal("host accepted its own signature as the client's")
+	}
+}
+
+func TestPAKEWrongPassword(t *testing.T) {
+	hostPeer, clientPeer, results := pakePeers(t, NewPAKEHandshake(true, []byte("7-crossbow-pilot")))
+	onHost, onClient := pakeConnect(t, hostPeer, clientPeer, results, "7-crossbow-pylon")
+
+	if !errors.Is(onHost.err, ErrWrongPassword) {
+		t.Errorf("host: %v, want %v", onHost.err, ErrWrongPassword)
+	}
+	if !errors.Is(onClient.err, ErrWrongPassword) {
+		t.Errorf("client: %v, want %v", onClient.err, ErrWrongPassword)
+	}
+}
+
+func TestPAKELockout(t *testing.T) {
+	hostSide := NewPAKEHandshake(true, []byte("7-crossbow-pilot"))
+	hostPeer, clientPeer, results := pakePeers(t, hostSide)
+
+	for i := range maxPasswordFailures {
+		onHost, _ := pakeConnect(t, hostPeer, clientPeer, results, "guess")
+		if !errors.Is(onHost.err, ErrWrongPassword) {
+			t.Fatalf("attempt %d: host %v, want %v", i+1, onHost.err, ErrWrongPassword)
+		}
+	}
+
+	// Even the right password is refused now.
+	onHost, onClient := pakeConnect(t, hostPeer, clientPeer, results, "7-crossbow-pilot")
+	if !errors.Is(onHost.err, errPasswordLocked) {
+		t.Errorf("host: %v, want %v", onHost.err, errPasswordLocked)
+	}
+	if onClient.err == nil {
+		t.Error("client got in after the host locked")
+	}
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// Policy actions.
+const (
+	ActionAllow  = "allow"
+	ActionDeny   = "deny"
+	ActionPrompt = "prompt"
+)
+
+// Policy decides which clients a host accepts without asking for each
+// one. It is read from a YAML file:
+//
+//	default: prompt
+//	rules:
+//	  - name: team
+//	    fingerprints: [0123456789ABCDEF0123456789ABCDEF01234567]
+//	    action: allow
+//	    files: ["*.env"]
+//	    hours: "09:00-18:00"
+//	    days: [mon, tue, wed, thu, fri]
+//	  - name: outsiders
+//	    uids: ["*@example.org"]
+//	    action: deny
+//
+// The first rule matching the client's fingerprint or one of the user IDs on
+// its key, at a time within its window, decides. Without a match the default
+// applies. Anyone can put any user ID on a key they make, so only rules that
+// match by fingerprint alone may allow.
+type Policy struct {
+	Default string       `yaml:"default"`
+	Rules   []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule matches clients by fingerprint or user ID pattern. Files, if
+// set, limits which shared files matching clients are offered; Hours and
+// Days limit when the rule applies.
+type PolicyRule struct {
+	Name         string   `yaml:"name"`
+	Fingerprints []string `yaml:"fingerprints"`
+	UIDs         []string `yaml:"uids"`
+	Action       string   `yaml:"action"`
+	Files        []string `yaml:"files"`
+	Hours        string   `yaml:"hours"`
+	Days         []string `yaml:"days"`
+
+	from, until time.Duration // Hours as offsets into the day
+	days        []time.Weekday
+}
+
+// Decision is what the policy says about a client.
+type Decision struct {
+	Action string
+	Rule   string   // the rule that matched, or "default"
+	Files  []string // patterns of the files the client may get, nil for all
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// LoadPolicy reads the policy file at path. Unknown keys are an error, so a
+// typo doesn't silently turn a rule off.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := yaml.UnmarshalStrict(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if p.Default == "" {
+		p.Default = ActionPrompt
+	}
+	if !validAction(p.Default) {
+		return nil, fmt.Errorf("%s: default: unknown action %q, use %s, %s or %s", path, p.Default, ActionAllow, ActionDeny, ActionPrompt)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, rule.Name, err)
+		}
+	}
+
+	return &p, nil
+}
+
+func validAction(action string) bool {
+	return action == ActionAllow || action == ActionDeny || action == ActionPrompt
+}
+
+func (r *PolicyRule) compile() error {
+	if !validAction(r.Action) {
+		return fmt.Errorf("unknown action %q, use %s, %s or %s", r.Action, ActionAllow, ActionDeny, ActionPrompt)
+	}
+	if len(r.Fingerprints) == 0 && len(r.UIDs) == 0 {
+		return fmt.Errorf("needs fingerprints or uids to match")
+	}
+	if r.Action == ActionAllow && len(r.UIDs) > 0 {
+		return fmt.Errorf("uids can't allow, anyone can make a key with any user ID, list fingerprints instead")
+	}
+
+	for i, fingerprint := range r.Fingerprints {
+		fingerprint = strings.ToUpper(strings.ReplaceAll(fingerprint, " ", ""))
+		if !validFingerprint(fingerprint) {
+			return fmt.Errorf("%q is not a full GPG fingerprint", r.Fingerprints[i])
+		}
+		r.Fingerprints[i] = fingerprint
+	}
+
+	for _, pattern := range append(slices.Clone(r.UIDs), r.Files...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+	}
+
+	if r.Hours != "" {
+		start, end, ok := strings.Cut(r.Hours, "-")
+		from, err1 := parseClock(start)
+		until, err2 := parseClock(end)
+		if !ok || err1 != nil || err2 != nil {
+			return fmt.Errorf("hours %q should look like 09:00-17:30", r.Hours)
+		}
+		r.from, r.until = from, until
+	}
+
+	for _, day := range r.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown day %q, use mon, tue, wed, thu, fri, sat or sun", day)
+		}
+		r.days = append(r.days, weekday)
+	}
+
+	return nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// matches reports whether the rule is about the client. A UID pattern is
+// matched against each whole user ID and against the email address in it,
+// so "*@example.com" matches "Alice <alice@example.com>".
+func (r *PolicyRule) matches(fingerprint string, userIDs []string) bool {
+	if slices.Contains(r.Fingerprints, fingerprint) {
+		return true
+	}
+
+	for _, userID := range userIDs {
+		uid := strings.ToLower(userID)
+		email := uid
+		if start := strings.LastIndex(uid, "<"); start >= 0 && strings.HasSuffix(uid, ">") {
+			email = uid[start+1 : len(uid)-1]
+		}
+
+		for _, pattern := range r.UIDs {
+			pattern = strings.ToLower(pattern)
+			if ok, _ := path.Match(pattern, uid); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, email); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// active reports whether now is within the rule's window. A window like
+// 22:00-06:00 runs past midnight, and its day is the one it started on.
+func (r *PolicyRule) active(now time.Time) bool {
+	if r.Hours == "" {
+		return len(r.days) == 0 || slices.Contains(r.days, now.Weekday())
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	clock := now.Sub(midnight)
+	day := now.Weekday()
+
+	switch {
+	case r.from <= r.until:
+		if clock < r.from || clock >= r.until {
+			return false
+		}
+	case clock >= r.from:
+	case clock < r.until:
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	return len(r.days) == 0 || slices.Contains(r.days, day)
+}
+
+// Decide returns what to do at time now with the client that proved it
+// holds the key with fingerprint. userIDs must come from that key, never
+// from what the client claims.
+func (p *Policy) Decide(fingerprint string, userIDs []string, now time.Time) Decision {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.matches(fingerprint, userIDs) && rule.active(now) {
+			return Decision{Action: rule.Action, Rule: rule.Name, Files: rule.Files}
+		}
+	}
+	return Decision{Action: p.Default, Rule: "default"}
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+func newTestBackend(t *testing.T, name, email string) (*NativeBackend, string) {
+	t.Helper()
+
+	e, err := openpgp.NewEntity(name, "", email, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &NativeBackend{secret: openpgp.EntityList{e}, trusted: make(map[string]bool)}, entityFingerprint(e)
+}
+
+func writePolicy(t *testing.T, yaml string) (*Policy, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadPolicy(path)
+}
+
+func TestVerifyPeerRejectsSpoofedUserID(t *testing.T) {
+	mallory, fingerprint := newTestBackend(t, "Mallory", "mallory@example.org")
+	publicKey, err := mallory.Export(fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statement := []byte("challenge")
+	signature, err := mallory.Sign(statement, fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof := &wire.Proof{Signature: signature}
+
+	host := NewGPGHandshake(true, &NativeBackend{trusted: make(map[string]bool)}, nil)
+
+	spoofed := &wire.Hello{UserID: "x <alice@example.com>", Fingerprint: fingerprint, PublicKey: publicKey}
+	if _, err := host.verifyPeer(spoofed, proof, statement); err == nil {
+		t.Fatal("verifyPeer accepted a user ID that is not on the key")
+	}
+
+	honest := &wire.Hello{UserID: "Mallory <mallory@example.org>", Fingerprint: fingerprint, PublicKey: publicKey}
+	userIDs, err := host.verifyPeer(honest, proof, statement)
+	if err != nil {
+		t.Fatalf("verifyPeer: %v", err)
+	}
+	if !slices.Equal(userIDs, []string{"Mallory <mallory@example.org>"}) {
+		t.Fatalf("user IDs = %q", userIDs)
+	}
+}
+
+func TestLoadPolicyRefusesAllowByUID(t *testing.T) {
+	_, err := writePolicy(t, `
+rules:
+  - uids: ["*@example.com"]
+    action: allow
+`)
+	if err == nil || !strings.Contains(err.Error(), "uids can't allow") {
+		t.Fatalf("LoadPolicy = %v, want an error about uids", err)
+	}
+}
+
+func TestPolicySpoofedUserIDIsNotAllowed(t *testing.T) {
+	_, alice := newTestBackend(t, "Alice", "alice@example.com")
+	_, mallory := newTestBackend(t, "Mallory", "mallory@example.org")
+
+	p, err := writePolicy(t, `
+default: deny
+rules:
+  - name: alice
+    fingerprints: [`+alice+`]
+    action: allow
+  - name: colleagues
+    uids: ["*@example.com"]
+    action: prompt
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		fingerprint string
+		userIDs     []string
+		want        Decision
+	}{
+		{alice, []string{"Alice <alice@example.com>"}, Decision{Action: ActionAllow, Rule: "alice"}},
+		// Mallory made a key with Alice's address on it.
+		{mallory, []string{"Alice <alice@example.com>"}, Decision{Action: ActionPrompt, Rule: "colleagues"}},
+		{mallory, []string{"Mallory <mallory@example.org>"}, Decision{Action: ActionDeny, Rule: "default"}},
+	}
+	for _, tt := range tests {
+		got := p.Decide(tt.fingerprint, tt.userIDs, now)
+		if got.Action != tt.want.Action || got.Rule != tt.want.Rule {
+			t.Errorf("Decide(%s, %q) = %s by %s, want %s by %s", tt.fingerprint, tt.userIDs, got.Action, got.Rule, tt.want.Action, tt.want.Rule)
+		}
+	}
+}
+
+func TestPolicyRuleActive(t *testing.T) {
+	p, err := writePolicy(t, `
+rules:
+  - name: office
+    uids: [a]
+    action: deny
+    hours: "09:00-17:00"
+    days: [mon]
+  - name: night
+    uids: [b]
+    action: deny
+    hours: "22:00-06:00"
+    days: [fri]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	office, night := &p.Rules[0], &p.Rules[1]
+
+	// 2024-01-01 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		rule *PolicyRule
+		now  time.Time
+		want bool
+	}{
+		{office, at(1, 9, 0), true},
+		{office, at(1, 16, 59), true},
+		{office, at(1, 17, 0), false},
+		{office, at(1, 8, 59), false},
+		{office, at(2, 12, 0), false},
+		{night, at(5, 23, 0), true},
+		{night, at(6, 5, 0), true}, // Saturday morning, the window started Friday
+		{night, at(6, 23, 0), false},
+		{night, at(5, 5, 0), false},
+		{night, at(5, 12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.active(tt.now); got != tt.want {
+			t.Errorf("%s active at %s = %v, want %v", tt.rule.Name, tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
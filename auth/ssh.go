@@ -0,0 +1,360 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/Noah-Wilderom/secretshare/prompt"
+	"github.com/Noah-Wilderom/secretshare/wire"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"github.com/libp2p/go-libp2p/core/network"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHKey is an ssh-ed25519 key that signs handshakes and decrypts what was
+// encrypted to it.
+type SSHKey struct {
+	signer   ssh.Signer
+	identity age.Identity
+	comment  string
+}
+
+// LoadSSHKey reads the OpenSSH ed25519 private key at path, asking for its
+// passphrase if it has one. The comment of the public key next to it, if
+// any, is the name the key is announced under.
+func LoadSSHKey(path string) (*SSHKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		var passphrase []byte
+		passphrase, err = prompt.Password(fmt.Sprintf("Passphrase for %s: ", path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key, ok := raw.(*ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: only ssh-ed25519 keys are supported", path)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := agessh.NewEd25519Identity(*key)
+	if err != nil {
+		return nil, err
+	}
+
+	comment := ""
+	if pub, err := os.ReadFile(path + ".pub"); err == nil {
+		if _, c, _, _, err := ssh.ParseAuthorizedKey(pub); err == nil {
+			comment = c
+		}
+	}
+
+	return &SSHKey{signer: signer, identity: identity, comment: comment}, nil
+}
+
+// SSHHandshake authenticates both sides by their SSH keys, the way
+// GPGHandshake does with GPG keys, and encrypts payloads to the client's
+// SSH key with age.
+type SSHHandshake struct {
+	isHost  bool
+	key     *SSHKey
+	allowed *AllowedSigners // Client keys the host accepts without asking, may be nil
+	known   *KnownPeers     // Hosts trusted before, nil to not keep track
+}
+
+func NewSSHHandshake(isHost bool, key *SSHKey, allowed *AllowedSigners, known *KnownPeers) *SSHHandshake {
+	return &SSHHandshake{
+		isHost:  isHost,
+		key:     key,
+		allowed: allowed,
+		known:   known,
+	}
+}
+
+func (h *SSHHandshake) localHello() (*wire.Hello, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	public := h.key.signer.PublicKey()
+	log.Printf("Using SSH key: %s %s\n", ssh.FingerprintSHA256(public), h.key.comment)
+
+	return &wire.Hello{
+		UserID:      h.key.comment,
+		Fingerprint: ssh.FingerprintSHA256(public),
+		PublicKey:   ssh.MarshalAuthorizedKey(public),
+		Nonce:       nonce,
+	}, nil
+}
+
+// parseSSHHello checks the hello and returns the key it announced.
+func parseSSHHello(hello *wire.Hello) (ssh.PublicKey, error) {
+	if strings.ContainsFunc(hello.UserID, unicode.IsControl) {
+		return nil, errors.New("peer sent a name with control characters")
+	}
+	if len(hello.Nonce) != nonceSize {
+		return nil, fmt.Errorf("peer sent a %d byte nonce, want %d", len(hello.Nonce), nonceSize)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(hello.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("peer sent an invalid SSH key: %w", err)
+	}
+	if key.Type() != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("peer sent an %s key, only ssh-ed25519 is supported", key.Type())
+	}
+	if hello.Fingerprint != ssh.FingerprintSHA256(key) {
+		return nil, errors.New("peer sent a fingerprint that does not match its key")
+	}
+	return key, nil
+}
+
+func (h *SSHHandshake) sign(statement []byte) ([]byte, error) {
+	signature, err := h.key.signer.Sign(rand.Reader, statement)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(signature), nil
+}
+
+func verifySSH(key ssh.PublicKey, data []byte, signature []byte) error {
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(signature, &sig); err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	return key.Verify(data, &sig)
+}
+
+func (h *SSHHandshake) Handshake(s network.Stream) (*Result, error) {
+	codec := wire.NewCodec(s)
+
+	if h.isHost {
+		return h.hostHandshake(s, codec)
+	}
+	return h.clientHandshake(s, codec)
+}
+
+func (h *SSHHandshake) hostHandshake(s network.Stream, codec *wire.Codec) (*Result, error) {
+	clientHello, err := wire.Expect[*wire.Hello](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello from client: %w", err)
+	}
+
+	clientKey, err := parseSSHHello(clientHello)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hello from client: %w", err)
+	}
+
+	recipient, err := agessh.NewEd25519Recipient(clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hello from client: %w", err)
+	}
+
+	hello, err := h.localHello()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := codec.WriteMessage(hello); err != nil {
+		return nil, fmt.Errorf("failed to send hello to client: %w", err)
+	}
+
+	c := challenge{
+		protocol:          s.Protocol(),
+		clientNonce:       clientHello.Nonce,
+		hostNonce:         hello.Nonce,
+		clientFingerprint: clientHello.Fingerprint,
+		hostFingerprint:   hello.Fingerprint,
+		clientPeer:        s.Conn().RemotePeer(),
+		hostPeer:          s.Conn().LocalPeer(),
+	}
+
+	proof, err := wire.Expect[*wire.Proof](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proof from client: %w", err)
+	}
+
+	if err := verifySSH(clientKey, c.statement(roleClient), proof.Signature); err != nil {
+		codec.WriteMessage(&wire.Error{Message: "identity proof rejected"})
+		return nil, fmt.Errorf("client failed to prove its SSH key: %w", err)
+	}
+	log.Printf("Client proved ownership of SSH key %s\n", clientHello.Fingerprint)
+
+	name := clientHello.UserID
+	if listed, ok := h.lookupAllowed(clientKey); ok {
+		name = listed
+		log.Printf("SSH key %s is an allowed signer (%s), accepting without asking\n", clientHello.Fingerprint, name)
+	} else if !promptUserAcceptance(kindSSH, name, clientHello.Fingerprint) {
+		codec.WriteMessage(&wire.Reject{Reason: "connection rejected by host"})
+		return nil, fmt.Errorf("%w: connection from %s declined", ErrRejected, clientHello.Fingerprint)
+	}
+
+	signature, err := h.sign(c.statement(roleHost))
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "host failed to sign challenge"})
+		return nil, fmt.Errorf("failed to sign challenge: %w", err)
+	}
+
+	if err := codec.WriteMessage(&wire.Proof{Signature: signature}); err != nil {
+		return nil, fmt.Errorf("failed to send proof to client: %w", err)
+	}
+
+	log.Printf("Connection accepted from: %s (fingerprint: %s)\n", name, clientHello.Fingerprint)
+
+	return h.result(s, name, clientHello, clientKey, &ageEncryptor{recipient: recipient}), nil
+}
+
+func (h *SSHHandshake) lookupAllowed(key ssh.PublicKey) (string, bool) {
+	if h.allowed == nil {
+		return "", false
+	}
+	return h.allowed.Lookup(key)
+}
+
+func (h *SSHHandshake) clientHandshake(s network.Stream, codec *wire.Codec) (*Result, error) {
+	hello, err := h.localHello()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := codec.WriteMessage(hello); err != nil {
+		return nil, fmt.Errorf("failed to send hello to host: %w", err)
+	}
+
+	hostHello, err := wire.Expect[*wire.Hello](codec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello from host: %w", err)
+	}
+
+	hostKey, err := parseSSHHello(hostHello)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hello from host: %w", err)
+	}
+
+	c := challenge{
+		protocol:          s.Protocol(),
+		clientNonce:       hello.Nonce,
+		hostNonce:         hostHello.Nonce,
+		clientFingerprint: hello.Fingerprint,
+		hostFingerprint:   hostHello.Fingerprint,
+		clientPeer:        s.Conn().LocalPeer(),
+		hostPeer:          s.Conn().RemotePeer(),
+	}
+
+	signature, err := h.sign(c.statement(roleClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign challenge: %w", err)
+	}
+
+	if err := codec.WriteMessage(&wire.Proof{Signature: signature}); err != nil {
+		return nil, fmt.Errorf("failed to send proof to host: %w", err)
+	}
+
+	response, err := codec.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from host: %w", err)
+	}
+
+	var proof *wire.Proof
+	switch m := response.(type) {
+	case *wire.Proof:
+		proof = m
+	case *wire.Reject:
+		return nil, fmt.Errorf("%w by host: %s", ErrRejected, m.Reason)
+	case *wire.Error:
+		return nil, fmt.Errorf("handshake aborted by host: %w", m)
+	default:
+		return nil, fmt.Errorf("%w: got %s during handshake", wire.ErrUnexpectedMessage, m.Type())
+	}
+
+	log.Println("Connection accepted by host, verifying host's SSH key...")
+	if err := verifySSH(hostKey, c.statement(roleHost), proof.Signature); err != nil {
+		return nil, fmt.Errorf("host failed to prove its SSH key: %w", err)
+	}
+
+	result := h.result(s, hostHello.UserID, hostHello, hostKey, &ageEncryptor{identities: []age.Identity{h.key.identity}})
+
+	var note string
+	if h.known != nil {
+		if note, err = h.known.Check(result.Peer); err != nil {
+			codec.WriteMessage(&wire.Reject{Reason: "host does not match the client's known peers"})
+			return nil, err
+		}
+	}
+
+	if !promptHostTrust(kindSSH, hostHello.UserID, hostHello.Fingerprint, note) {
+		codec.WriteMessage(&wire.Reject{Reason: "host identity not confirmed by client"})
+		return nil, fmt.Errorf("%w: host identity not confirmed", ErrRejected)
+	}
+
+	if h.known != nil {
+		if err := h.known.Remember(result.Peer); err != nil {
+			log.Printf("Warning: Could not remember host: %v\n", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (h *SSHHandshake) result(s network.Stream, name string, peerHello *wire.Hello, peerKey ssh.PublicKey, encryptor Encryptor) *Result {
+	if name == "" {
+		// Keys without a comment go by their fingerprint.
+		name = peerHello.Fingerprint
+	}
+	return &Result{
+		Peer: Identity{
+			Name:        name,
+			Fingerprint: peerHello.Fingerprint,
+			PeerID:      s.Conn().RemotePeer(),
+		},
+		RecipientKey: peerHello.Fingerprint,
+		Cipher: &sshCipher{
+			Encryptor: encryptor,
+			signer:    h.key.signer,
+			peer:      peerKey,
+		},
+	}
+}
+
+// sshCipher signs with our SSH key and verifies with the peer's. Payloads
+// are encrypted with age to the client's SSH key.
+type sshCipher struct {
+	Encryptor
+	signer ssh.Signer
+	peer   ssh.PublicKey
+}
+
+func (c *sshCipher) Sign(data []byte) ([]byte, error) {
+	signature, err := c.signer.Sign(rand.Reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.Marshal(signature), nil
+}
+
+func (c *sshCipher) Verify(data []byte, signature []byte) error {
+	return verifySSH(c.peer, data, signature)
+}
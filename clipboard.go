@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"golang.design/x/clipboard"
+)
+
+// defaultClipboardTimeout is how long a received secret stays in the
+// clipboard unless -clipboard-timeout says otherwise.
+const defaultClipboardTimeout = 45 * time.Second
+
+var errNoClipboard = errors.New("no clipboard available, it needs a desktop session (X11 on Linux)")
+
+// initClipboard sets up the system clipboard the first time it is needed.
+// Reading or writing after a failed setup would panic.
+var initClipboard = sync.OnceValue(func() error {
+	// The package's own error explains at length how to install X11.
+	if err := clipboard.Init(); err != nil {
+		return errNoClipboard
+	}
+	return nil
+})
+
+// writeClipboard replaces the contents of the clipboard with text. The
+// returned channel fires once something else takes the clipboard over.
+func writeClipboard(text []byte) (<-chan struct{}, error) {
+	if err := initClipboard(); err != nil {
+		return nil, err
+	}
+
+	changed := clipboard.Write(clipboard.FmtText, text)
+	if changed == nil {
+		return nil, errors.New("failed to write to the clipboard")
+	}
+	return changed, nil
+}
+
+// copyToClipboard puts text in the clipboard for the user to paste.
+func copyToClipboard(text string) error {
+	_, err := writeClipboard([]byte(text))
+	return err
+}
+
+// holdInClipboard puts the secret in the clipboard and blocks until timeout
+// has passed, the user copies something else or presses Ctrl+C. Then the
+// clipboard is cleared, unless it no longer holds the secret. Some systems
+// only serve the clipboard while we run, so we have to stay until then.
+func holdInClipboard(name string, secret []byte, timeout time.Duration) error {
+	changed, err := writeClipboard(secret)
+	if err != nil {
+		return err
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	log.Printf("Copied %s to the clipboard, it will be cleared in %s (Ctrl+C clears it now)\n", name, timeout)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		log.Println("Clipboard was overwritten, leaving it as is")
+		return nil
+	case <-timer.C:
+	case <-interrupt:
+	}
+
+	if !bytes.Equal(clipboard.Read(clipboard.FmtText), secret) {
+		log.Println("Clipboard was overwritten, leaving it as is")
+		return nil
+	}
+	if _, err := writeClipboard(nil); err != nil {
+		return fmt.Errorf("failed to clear the clipboard: %w", err)
+	}
+
+	log.Println("Clipboard cleared")
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A pairing code like 7-crossbow-pilot is what a client types instead of
+// the host's address. The number is the nameplate the host is advertised
+// under on the local network, the words keep the code hard to guess.
+const (
+	maxNameplate = 99
+	codeWords    = 2
+)
+
+var errPairingCode = errors.New("invalid pairing code")
+
+type pairingCode struct {
+	nameplate int
+	words     [codeWords]string
+}
+
+func newPairingCode() (*pairingCode, error) {
+	nameplate, err := randomNameplate()
+	if err != nil {
+		return nil, err
+	}
+
+	code := &pairingCode{nameplate: nameplate}
+	for i := range code.words {
+		w, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeWordList))))
+		if err != nil {
+			return nil, err
+		}
+		code.words[i] = codeWordList[w.Int64()]
+	}
+	return code, nil
+}
+
+func randomNameplate() (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxNameplate))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + 1, nil
+}
+
+// isPairingCode tells a pairing code from a multiaddr, which always starts
+// with a slash.
+func isPairingCode(destination string) bool {
+	return destination != "" && !strings.HasPrefix(destination, "/")
+}
+
+func parsePairingCode(s string) (*pairingCode, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(s)), "-")
+	if len(parts) != codeWords+1 {
+		return nil, fmt.Errorf("%w %q: expected a number and %d words, like 7-crossbow-pilot", errPairingCode, s, codeWords)
+	}
+
+	nameplate, err := strconv.Atoi(parts[0])
+	if err != nil || nameplate < 1 || nameplate > maxNameplate {
+		return nil, fmt.Errorf("%w %q: it should start with a number from 1 to %d", errPairingCode, s, maxNameplate)
+	}
+
+	code := &pairingCode{nameplate: nameplate}
+	for i, word := range parts[1:] {
+		if _, ok := slices.BinarySearch(codeWordList, word); !ok {
+			return nil, fmt.Errorf("%w %q: %q is not one of its words, check for typos", errPairingCode, s, word)
+		}
+		code.words[i] = word
+	}
+	return code, nil
+}
+
+func (c *pairingCode) String() string {
+	return fmt.Sprintf("%d-%s", c.nameplate, strings.Join(c.words[:], "-"))
+}
+
+// rendezvous is the mDNS service the host is advertised under. Only the
+// nameplate goes into it, the words never leave the two machines.
+func (c *pairingCode) rendezvous() string {
+	return fmt.Sprintf("_%s-%d._udp", AppName, c.nameplate)
+}
+
+// codeWordList holds the words of pairing codes, sorted. 256 words give
+// each one 8 bits.
+var codeWordList = []string{
+	"acorn", "acrobat", "adrift", "almond", "amber", "anchor", "anvil", "apple",
+	"apron", "arrow", "aspen", "atlas", "autumn", "badger", "bagel", "bamboo",
+	"banjo", "barley", "basket", "beacon", "beaver", "bicycle", "biscuit",
+	"blanket", "blizzard", "blossom", "bonfire", "bramble", "breeze", "bridge",
+	"bronze", "bucket", "buffalo", "bugle", "butter", "cabin", "cactus",
+	"camel", "candle", "canoe", "canyon", "carbon", "carpet", "castle", "cedar",
+	"cello", "cherry", "chimney", "cider", "cinnamon", "clover", "cobalt",
+	"coconut", "comet", "copper", "coral", "cotton", "cougar", "cradle",
+	"crayon", "cricket", "crossbow", "crystal", "cupcake", "dagger", "daisy",
+	"dolphin", "domino", "donkey", "dragon", "drum", "eagle", "echo", "eclipse",
+	"elbow", "ember", "emerald", "falcon", "feather", "fennel", "ferret",
+	"fiddle", "figure", "flannel", "flute", "forest", "fossil", "fountain",
+	"fox", "galaxy", "garden", "garlic", "gazelle", "geyser", "ginger",
+	"glacier", "goblet", "gopher", "granite", "gravel", "guitar", "hammer",
+	"harbor", "harvest", "hazel", "hedgehog", "helmet", "heron", "hickory",
+	"hollow", "honey", "horizon", "iceberg", "igloo", "indigo", "island",
+	"ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw", "juniper",
+	"kayak", "kennel", "kettle", "kiwi", "ladder", "lagoon", "lantern",
+	"laurel", "lemon", "lentil", "lighthouse", "lilac", "lizard", "lobster",
+	"locket", "lotus", "lumber", "magnet", "mango", "maple", "marble", "meadow",
+	"melon", "meteor", "mitten", "monsoon", "mosaic", "muffin", "mustard",
+	"napkin", "nectar", "needle", "nickel", "nutmeg", "oasis", "oatmeal",
+	"olive", "onion", "orbit", "orchid", "otter", "oyster", "paddle", "pancake",
+	"panther", "parrot", "peach", "pebble", "pelican", "pepper", "pickle",
+	"pilot", "pine", "pioneer", "planet", "plum", "pocket", "polka", "poppy",
+	"potato", "pretzel", "puffin", "pumpkin", "quartz", "quill", "quilt",
+	"rabbit", "raccoon", "radar", "radish", "raven", "ribbon", "river",
+	"rocket", "rooster", "ruby", "saddle", "saffron", "salmon", "sapphire",
+	"satchel", "scarlet", "seashell", "shadow", "sherbet", "silver", "sketch",
+	"sparrow", "spider", "spruce", "squirrel", "stallion", "summit", "sunset",
+	"swallow", "tadpole", "tangerine", "teapot", "thimble", "thistle",
+	"thunder", "tiger", "timber", "toffee", "tomato", "topaz", "tornado",
+	"trumpet", "tulip", "tundra", "turnip", "turtle", "umbrella", "unicorn",
+	"valley", "velvet", "violin", "volcano", "waffle", "wagon", "walnut",
+	"walrus", "whistle", "willow", "window", "wizard", "wombat", "yarrow",
+	"yodel", "zebra", "zenith", "zephyr", "zigzag",
+}
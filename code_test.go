@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCodeWordList(t *testing.T) {
+	if len(codeWordList) != 256 {
+		t.Fatalf("%d code words, want 256", len(codeWordList))
+	}
+	// parsePairingCode binary searches the list.
+	if !slices.IsSorted(codeWordList) {
+		t.Fatal("code words are not sorted")
+	}
+	for i, word := range codeWordList {
+		if i > 0 && word == codeWordList[i-1] {
+			t.Errorf("%q is listed twice", word)
+		}
+		if word != strings.ToLower(word) || strings.ContainsAny(word, "- ") {
+			t.Errorf("%q can't be typed back into a code", word)
+		}
+	}
+}
+
+func TestParsePairingCode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // empty if the code must be refused
+	}{
+		{"7-crossbow-pilot", "7-crossbow-pilot"},
+		{"  7-Crossbow-PILOT\n", "7-crossbow-pilot"},
+		{"1-crossbow-pilot", "1-crossbow-pilot"},
+		{"99-crossbow-pilot", "99-crossbow-pilot"},
+		{"0-crossbow-pilot", ""},
+		{"100-crossbow-pilot", ""},
+		{"-1-crossbow-pilot", ""},
+		{"x-crossbow-pilot", ""},
+		{"7-crossbow", ""},
+		{"7-crossbow-pilot-pilot", ""},
+		{"7-crossbow-pilott", ""},
+		{"7--pilot", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		code, err := parsePairingCode(tt.in)
+		if tt.want == "" {
+			if !errors.Is(err, errPairingCode) {
+				t.Errorf("%q: got %v, want an invalid pairing code error", tt.in, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if code.String() != tt.want {
+			t.Errorf("%q: parsed as %s, want %s", tt.in, code, tt.want)
+		}
+	}
+}
+
+func TestNewPairingCodeParses(t *testing.T) {
+	for range 100 {
+		code, err := newPairingCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := parsePairingCode(code.String())
+		if err != nil {
+			t.Fatalf("%s: %v", code, err)
+		}
+		if *parsed != *code {
+			t.Fatalf("%s parsed as %s", code, parsed)
+		}
+	}
+}
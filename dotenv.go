@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errDotenv = errors.New("invalid dotenv file")
+
+// envVar is a single variable from a dotenv file.
+type envVar struct {
+	key   string
+	value string
+}
+
+// parseDotenv reads KEY=VALUE lines. Blank lines and lines starting with #
+// are skipped, and an "export " prefix is allowed. Unquoted values end at
+// a " #" comment and are trimmed. Single quoted values are taken literally,
+// double quoted ones understand \n, \r, \t, \", \\ and \$. Both kinds of
+// quotes may span several lines. Variables are never expanded.
+func parseDotenv(data []byte) ([]envVar, error) {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return nil, fmt.Errorf("%w: contains a NUL byte", errDotenv)
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimPrefix(text, "\ufeff")
+
+	var vars []envVar
+	lineNo := 0
+	for text != "" {
+		var line string
+		line, text, _ = strings.Cut(text, "\n")
+		lineNo++
+
+		// Trailing blanks are kept, they may belong to a quoted value that
+		// continues on the next line.
+		line = strings.TrimLeft(line, " \t")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, rest, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validEnvKey(key) {
+			return nil, fmt.Errorf("%w: line %d is not KEY=VALUE", errDotenv, lineNo)
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		switch {
+		case strings.HasPrefix(rest, "'") || strings.HasPrefix(rest, `"`):
+			start := lineNo
+			var lines int
+			var err error
+			// The closing quote may be on a later line, so the value is read
+			// from the rest of the text, not just this line.
+			value, text, lines, err = parseQuoted(rest+"\n"+text, rest[0])
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", errDotenv, start, err)
+			}
+			lineNo += lines
+		default:
+			value = rest
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = value[:i]
+			}
+			value = strings.TrimSpace(value)
+		}
+
+		vars = append(vars, envVar{key, value})
+	}
+
+	return vars, nil
+}
+
+// parseQuoted reads the quoted value at the start of s. It returns the
+// value, the text after the line the value ends on and how many line breaks
+// the value spans.
+func parseQuoted(s string, quote byte) (string, string, int, error) {
+	var value strings.Builder
+	lines := 0
+
+	i := 1
+	for ; i < len(s) && s[i] != quote; i++ {
+		c := s[i]
+		if c == '\n' {
+			lines++
+		}
+		if c != '\\' || quote == '\'' || i+1 == len(s) {
+			value.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		case 't':
+			value.WriteByte('\t')
+		case '"', '\\', '$':
+			value.WriteByte(s[i])
+		default:
+			value.WriteByte('\\')
+			value.WriteByte(s[i])
+			if s[i] == '\n' {
+				lines++
+			}
+		}
+	}
+	if i == len(s) {
+		return "", "", 0, errors.New("missing closing quote")
+	}
+
+	rest, next, _ := strings.Cut(s[i+1:], "\n")
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", "", 0, fmt.Errorf("unexpected %q after the closing quote", rest)
+	}
+	return value.String(), next, lines, nil
+}
+
+// validEnvKey reports whether key is a portable environment variable name.
+func validEnvKey(key string) bool {
+	if key == "" || key[0] >= '0' && key[0] <= '9' {
+		return false
+	}
+	for _, c := range key {
+		if c != '_' && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
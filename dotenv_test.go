@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []envVar
+		err  string // part of the error, if parsing must fail
+	}{
+		{"plain", "A=1\nB = two \n", []envVar{{"A", "1"}, {"B", "two"}}, ""},
+		{"empty value", "A=\nB=''\n", []envVar{{"A", ""}, {"B", ""}}, ""},
+		{"blank lines and comments", "\n  # comment\n\t\nA=1\n#B=2\n", []envVar{{"A", "1"}}, ""},
+		{"crlf and bom", "\ufeffA=1\r\nB=2\r\n", []envVar{{"A", "1"}, {"B", "2"}}, ""},
+		{"no trailing newline", "A=1", []envVar{{"A", "1"}}, ""},
+		{"export", "export A=1\n  export B='2'\n", []envVar{{"A", "1"}, {"B", "2"}}, ""},
+		{"export as a key", "export=1\n", []envVar{{"export", "1"}}, ""},
+		{"comment after value", "A=1 # one\nB=a#b\n", []envVar{{"A", "1"}, {"B", "a#b"}}, ""},
+		{"comment after quotes", `A="1 # kept" # dropped` + "\nB='2'# dropped\n", []envVar{{"A", "1 # kept"}, {"B", "2"}}, ""},
+		{"equals in value", "A=b=c\n", []envVar{{"A", "b=c"}}, ""},
+		{"unquoted quote inside", "A=it's\n", []envVar{{"A", "it's"}}, ""},
+		{"no expansion", "A=$HOME\nB=\"${HOME}\"\n", []envVar{{"A", "$HOME"}, {"B", "${HOME}"}}, ""},
+
+		{"single quotes are literal", `A='a\nb "c" \$d'`, []envVar{{"A", `a\nb "c" \$d`}}, ""},
+		{"double quote escapes", `A="a\nb\tc\rd \"e\" \\ \$f"`, []envVar{{"A", "a\nb\tc\rd \"e\" \\ $f"}}, ""},
+		{"unknown escape is kept", `A="\q"`, []envVar{{"A", `\q`}}, ""},
+		{"single quote in double quotes", `A="it's"`, []envVar{{"A", "it's"}}, ""},
+		{"multi-line", "A=\"one\ntwo\"\nB='three\n four'\nC=5\n", []envVar{{"A", "one\ntwo"}, {"B", "three\n four"}, {"C", "5"}}, ""},
+		{"blanks kept in quotes", "A='  a  '\n", []envVar{{"A", "  a  "}}, ""},
+
+		{"no equals", "A\n", nil, "line 1 is not KEY=VALUE"},
+		{"key with a dash", "A-B=1\n", nil, "line 1 is not KEY=VALUE"},
+		{"key with a digit first", "1A=1\n", nil, "line 1 is not KEY=VALUE"},
+		{"key with a space", "A B=1\n", nil, "line 1 is not KEY=VALUE"},
+		{"empty key", "=1\n", nil, "line 1 is not KEY=VALUE"},
+		{"non-ascii key", "Ä=1\n", nil, "line 1 is not KEY=VALUE"},
+		{"line number after multi-line value", "A='1\n2'\nB\n", nil, "line 3 is not KEY=VALUE"},
+		{"unterminated double quote", "A=1\nB=\"open\nC=3\n", nil, "line 2: missing closing quote"},
+		{"unterminated single quote", "A='open", nil, "line 1: missing closing quote"},
+		{"escaped closing quote", `A="open\"`, nil, "line 1: missing closing quote"},
+		{"text after closing quote", `A="a" b`, nil, `line 1: unexpected "b" after the closing quote`},
+		{"nul byte", "A=\x00\n", nil, "contains a NUL byte"},
+	}
+	for _, tt := range tests {
+		vars, err := parseDotenv([]byte(tt.in))
+		if tt.err != "" {
+			if err == nil || !errors.Is(err, errDotenv) || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want an error about %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !slices.Equal(vars, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, vars, tt.want)
+		}
+	}
+}
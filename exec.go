@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// forwardedSignals are passed on to the command run with -exec, so it can
+// shut down cleanly when secretshare is asked to stop.
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// commandExit reports that the command run with -exec failed. secretshare
+// exits with the same status.
+type commandExit struct {
+	code int
+}
+
+func (e *commandExit) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.code)
+}
+
+// runWithEnv runs command with the variables of the dotenv secret added to
+// our own environment. The secret only ever lives in memory and in the
+// environment of the command.
+func runWithEnv(command []string, secret []byte) error {
+	vars, err := parseDotenv(secret)
+	if err != nil {
+		return err
+	}
+	if len(vars) == 0 {
+		return fmt.Errorf("%w: no variables found", errDotenv)
+	}
+
+	env := os.Environ()
+	for _, v := range vars {
+		env = append(env, v.key+"="+v.value)
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Catch the signals before starting, so none of them kills us while the
+	// command keeps running.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	log.Printf("Running %s with %d variables from the secret\n", command[0], len(vars))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case sig := <-signals:
+			// The command shares our process group, so it can still read
+			// from the terminal. A Ctrl+C on that terminal already reached
+			// it, sending it again could make it quit hard.
+			if !fromTerminal(sig) {
+				cmd.Process.Signal(sig)
+			}
+		case err := <-done:
+			return exitStatus(err)
+		}
+	}
+}
+
+// exitStatus turns the result of waiting for the command into a
+// commandExit. A command killed by a signal exits like it would in a shell,
+// with 128 plus the signal number.
+func exitStatus(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	code := exitErr.ExitCode()
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		code = 128 + int(status.Signal())
+	}
+	return &commandExit{code: code}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fromTerminal always reports false where there are no process groups, so
+// every signal is passed on.
+func fromTerminal(sig os.Signal) bool {
+	return false
+}
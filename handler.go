@@ -1,16 +1,20 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"slices"
+	"time"
 
 	"github.com/Noah-Wilderom/secretshare/auth"
+	"github.com/Noah-Wilderom/secretshare/prompt"
+	"github.com/Noah-Wilderom/secretshare/wire"
 
 	"github.com/libp2p/go-libp2p/core/network"
 )
@@ -28,152 +32,619 @@ func formatFileSize(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func promptFileAcceptance(filename string, fileSize int64) bool {
-	fmt.Printf("\nIncoming file: %s (%s)\n", filename, formatFileSize(fileSize))
-	fmt.Print("Download this file? (y/N): ")
+func promptFileAcceptance(entry *wire.Entry) bool {
+	if entry.Format != wire.FormatFile {
+		return prompt.Confirm(fmt.Sprintf("\nIncoming directory: %s (%s)\nDownload this directory?", entry.Name, formatFileSize(entry.Size)))
+	}
+	return prompt.Confirm(fmt.Sprintf("\nIncoming file: %s (%s)\nDownload this file?", entry.Name, formatFileSize(entry.Size)))
+}
 
-	reader := bufio.NewReader(os.Stdin)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("Failed to read user input: %v\n", err)
-		return false
+// ackWindow is how many chunks the host sends before it waits for the
+// client to acknowledge the oldest one.
+const ackWindow = 32
+
+// sendOptions controls what the host shares.
+type sendOptions struct {
+	filePaths  []string // files and directories to share
+	compress   bool     // compress directories with zstd
+	secret     []byte   // shared from memory if not nil
+	secretName string   // name the secret is offered under
+
+	maxDownloads int           // end the offer after this many downloads, 0 means never
+	expire       time.Duration // end the offer after this long, 0 means never
+	shred        bool          // overwrite and remove the shared files when the offer ends
+}
+
+// checkLimits validates the options that end the offer.
+func (o sendOptions) checkLimits() error {
+	switch {
+	case o.maxDownloads < 0:
+		return fmt.Errorf("-max-downloads can't be negative")
+	case o.expire < 0:
+		return fmt.Errorf("-expire can't be negative")
+	case o.shred && o.maxDownloads == 0 && o.expire == 0:
+		return fmt.Errorf("-shred needs -max-downloads or -expire, the files would never be shredded")
 	}
 
-	response = strings.TrimSpace(strings.ToLower(response))
-	return response == "y" || response == "yes"
+	if o.shred {
+		for _, filePath := range o.filePaths {
+			if info, err := os.Stat(filePath); err == nil && !info.Mode().IsRegular() {
+				return fmt.Errorf("-shred only works with files, %s is not one", filePath)
+			}
+		}
+	}
+	return nil
 }
 
-func makeStreamHandler(handshaker *auth.GPGHandshake, filePath string) network.StreamHandler {
+func makeStreamHandler(handshaker auth.Handshaker, send sendOptions, transfers *transfers, limits *downloadLimits, sd *shutdown) network.StreamHandler {
 	return func(s network.Stream) {
 		log.Println("Got a new stream!")
 
-		if !handshaker.Handshake(s) {
-			log.Printf("Handshake failed with peer %s, rejecting connection\n", s.Conn().RemotePeer())
-			s.Reset()
+		// Don't bother the user with a handshake for files that are gone.
+		err := limits.Err()
+		if err == nil && !sd.track() {
+			err = errShuttingDown
+		}
+		if err != nil {
+			log.Printf("Turning away peer %s: %v\n", s.Conn().RemotePeer(), err)
+			wire.NewCodec(s).WriteMessage(offerError(err))
+			s.Close()
+			return
+		}
+		defer sd.untrack()
+
+		// Once the host stops, waiting for the client fails right away so
+		// the stream can be ended with a message instead of a reset.
+		stop := context.AfterFunc(sd.ctx, func() {
+			s.SetReadDeadline(time.Now())
+		})
+		defer stop()
+
+		result, err := handshaker.Handshake(s)
+		if err != nil {
+			if sd.ctx.Err() != nil {
+				log.Printf("Closing connection from peer %s, host shutting down\n", s.Conn().RemotePeer())
+				wire.NewCodec(s).WriteMessage(offerError(errShuttingDown))
+				s.Close()
+				return
+			}
+			log.Printf("Handshake failed with peer %s, rejecting connection: %v\n", s.Conn().RemotePeer(), err)
+			// Closed rather than reset, so the client still gets the
+			// reason the handshake wrote.
+			s.Close()
 			return
 		}
 
 		log.Printf("Handshake successful with peer %s, connection accepted\n", s.Conn().RemotePeer())
 
-		clientFingerprint := handshaker.GetClientFingerprint()
-		if clientFingerprint == "" {
-			log.Println("Error: No client fingerprint available")
+		if result.Cipher == nil || result.RecipientKey == "" {
+			log.Println("Error: Handshake did not agree on a key to encrypt to")
 			s.Reset()
 			return
 		}
 
-		if err := sendFile(s, filePath, clientFingerprint); err != nil {
-			log.Printf("Error sending file: %v\n", err)
+		sess := newSession(s, result)
+		if err := sess.sendFiles(send, transfers, limits); err != nil {
+			if sd.ctx.Err() != nil {
+				sess.logf("Transfer stopped, host shutting down\n")
+				sess.codec.WriteMessage(offerError(errShuttingDown))
+				s.Close()
+				return
+			}
+			sess.logf("Error sending file: %v\n", err)
+			if errors.Is(err, errNothingAllowed) {
+				s.Close()
+				return
+			}
 			s.Reset()
 			return
 		}
 
-		log.Println("File transfer completed successfully")
+		sess.logf("File transfer completed successfully\n")
 		s.Close()
 	}
 }
 
-func sendFile(s network.Stream, filePath string, recipientFingerprint string) error {
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+// errNothingAllowed is returned when the policy keeps every shared file
+// from the client.
+var errNothingAllowed = errors.New("policy allows none of the shared files for this client")
+
+func (ss *session) sendFiles(send sendOptions, transfers *transfers, limits *downloadLimits) error {
+	codec := ss.codec
+
+	if ss.client.SessionOnly {
+		defer transfers.drop(ss.client)
+	}
+
+	var sources []*payload
+	for _, filePath := range send.filePaths {
+		src, err := newPayload(filePath, send.compress)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+	}
+	if send.secret != nil {
+		sources = append(sources, newSecretPayload(send.secretName, send.secret))
+	}
+
+	sources = slices.DeleteFunc(sources, func(src *payload) bool {
+		if ss.client.Allows(src.name) {
+			return false
+		}
+		ss.logf("Not offering %s, the policy doesn't allow it for this client\n", src.name)
+		return true
+	})
+	if len(sources) == 0 {
+		codec.WriteMessage(&wire.Error{Message: "no files shared with you"})
+		return errNothingAllowed
 	}
 
-	fileName := filepath.Base(filePath)
-	fileSize := fileInfo.Size()
+	offer := &wire.Offer{ChunkSize: wire.ChunkSize}
 
-	log.Printf("Preparing to send file: %s (%s)\n", fileName, formatFileSize(fileSize))
+	for _, src := range sources {
+		if src.data != nil {
+			ss.logf("Preparing to send secret: %s (%s)\n", src.name, formatFileSize(src.size))
+		} else if src.isDir() {
+			ss.logf("Preparing to send directory: %s (%s as %s)\n", src.name, formatFileSize(src.size), src.format)
+		} else {
+			ss.logf("Preparing to send file: %s (%s)\n", src.name, formatFileSize(src.size))
+		}
+
+		id, err := transfers.transferID(src, ss.client)
+		if err != nil {
+			return err
+		}
+
+		digest, err := transfers.digests.get(src)
+		if err != nil {
+			return err
+		}
 
-	log.Println("Encrypting file with client's GPG key...")
-	encryptedData, err := auth.EncryptFile(filePath, recipientFingerprint)
+		offer.Entries = append(offer.Entries, wire.Entry{
+			Name:       src.name,
+			Size:       src.size,
+			TransferID: id,
+			Digest:     digest,
+			Format:     src.format,
+		})
+	}
+
+	if err := signOffer(offer, ss.client.Cipher); err != nil {
+		return fmt.Errorf("failed to sign offer: %w", err)
+	}
+
+	if err := codec.WriteMessage(offer); err != nil {
+		return fmt.Errorf("failed to send offer: %w", err)
+	}
+
+	ss.logf("Sent offer for %d file(s), waiting for client response...\n", len(offer.Entries))
+
+	response, err := codec.ReadMessage()
 	if err != nil {
-		return fmt.Errorf("failed to encrypt file: %w", err)
+		return fmt.Errorf("failed to read client response: %w", err)
 	}
 
-	encryptedSize := int64(len(encryptedData))
-	log.Printf("Encrypted file size: %s\n", formatFileSize(encryptedSize))
+	var selection *wire.Select
+	switch m := response.(type) {
+	case *wire.Select:
+		selection = m
+	case *wire.Reject:
+		ss.logf("Client rejected the file transfer\n")
+		return fmt.Errorf("client rejected file transfer: %s", m.Reason)
+	case *wire.Error:
+		return m
+	default:
+		return fmt.Errorf("%w: %s", wire.ErrUnexpectedMessage, m.Type())
+	}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	selected := make(map[uint64]bool)
+	for _, index := range selection.Entries {
+		if index >= uint64(len(sources)) || selected[index] {
+			codec.WriteMessage(&wire.Error{Message: "invalid selection"})
+			return fmt.Errorf("client selected entry %d of %d twice or out of range", index, len(sources))
+		}
+		selected[index] = true
+	}
+	if len(selected) == 0 {
+		codec.WriteMessage(&wire.Error{Message: "empty selection"})
+		return fmt.Errorf("client selected no files")
+	}
 
-	metadata := fmt.Sprintf("%s|%d|%d\n", fileName, fileSize, encryptedSize)
-	if _, err := rw.WriteString(metadata); err != nil {
-		return fmt.Errorf("failed to send metadata: %w", err)
+	ss.logf("Client selected %d of %d file(s)\n", len(selected), len(sources))
+
+	if err := limits.reserve(); err != nil {
+		codec.WriteMessage(offerError(err))
+		return err
+	}
+	completed := false
+	defer func() {
+		limits.release(completed)
+	}()
+
+	// Encrypt everything that was picked up front, so the next file is ready
+	// by the time the current one is sent.
+	spools := make(map[uint64]*spool, len(selected))
+	for _, index := range selection.Entries {
+		sp, err := transfers.open(sources[index], ss.client, offer.Entries[index].TransferID)
+		if err != nil {
+			codec.WriteMessage(&wire.Error{Message: "host failed to prepare the transfer"})
+			return err
+		}
+		sp.start()
+		spools[index] = sp
 	}
-	rw.Flush()
 
-	log.Println("Sent file metadata, waiting for client response...")
+	for _, index := range selection.Entries {
+		entry := &offer.Entries[index]
+		if err := ss.sendEntry(index, entry, spools[index]); err != nil {
+			return fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		transfers.finish(spools[index])
+	}
 
-	response, err := rw.ReadString('\n')
+	completed = true
+	return nil
+}
+
+// sendEntry streams one selected entry once the client asks for it.
+func (ss *session) sendEntry(entryIndex uint64, entry *wire.Entry, sp *spool) error {
+	codec := ss.codec
+
+	accept, err := wire.Expect[*wire.Accept](codec)
 	if err != nil {
 		return fmt.Errorf("failed to read client response: %w", err)
 	}
+	if accept.Entry != entryIndex {
+		codec.WriteMessage(&wire.Error{Message: "entries requested out of order"})
+		return fmt.Errorf("client requested entry %d, expected %d", accept.Entry, entryIndex)
+	}
 
-	response = strings.TrimSpace(response)
-	if response != "ACCEPT" {
-		log.Println("Client rejected the file transfer")
-		return fmt.Errorf("client rejected file transfer")
+	chain, err := sp.chainAt(accept.ResumeFrom)
+	if err != nil {
+		codec.WriteMessage(&wire.Error{Message: "cannot resume transfer"})
+		return fmt.Errorf("failed to resume at chunk %d: %w", accept.ResumeFrom, err)
+	}
+	if !bytes.Equal(chain, accept.Chain) {
+		codec.WriteMessage(&wire.Error{Message: "resume point does not match the host's data"})
+		return fmt.Errorf("client's chunks up to %d do not match", accept.ResumeFrom)
 	}
 
-	log.Println("Client accepted, sending encrypted file...")
+	if accept.ResumeFrom > 0 {
+		ss.logf("Resuming transfer %s of %s at chunk %d...\n", sp.id, entry.Name, accept.ResumeFrom)
+	} else {
+		ss.logf("Encrypting and streaming %s to %s...\n", entry.Name, ss.client.RecipientKey)
+	}
+
+	var pending [][]byte
+	index := accept.ResumeFrom
+	for {
+		data, err := sp.readChunk(index)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			codec.WriteMessage(&wire.Error{Message: "encryption failed on host"})
+			return fmt.Errorf("failed to encrypt file: %w", err)
+		}
 
-	encodedData := base64.StdEncoding.EncodeToString(encryptedData)
-	if _, err := rw.WriteString(encodedData + "\n"); err != nil {
-		return fmt.Errorf("failed to send encrypted file: %w", err)
+		digest := wire.ChunkDigest(data)
+		chain = wire.Chain(chain, digest)
+
+		if err := codec.WriteMessage(&wire.Chunk{Data: data, Index: index, Digest: digest}); err != nil {
+			return fmt.Errorf("failed to send chunk %d: %w", index, err)
+		}
+		pending = append(pending, chain)
+		index++
+
+		if len(pending) >= ackWindow {
+			if err := awaitAck(codec, index-uint64(len(pending)), pending[0]); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
 	}
-	rw.Flush()
 
-	log.Println("File sent successfully")
+	for len(pending) > 0 {
+		if err := awaitAck(codec, index-uint64(len(pending)), pending[0]); err != nil {
+			return err
+		}
+		pending = pending[1:]
+	}
+
+	if err := codec.WriteMessage(&wire.Done{Chunks: index, Chain: chain}); err != nil {
+		return fmt.Errorf("failed to finish transfer: %w", err)
+	}
+
+	ss.logf("Sent %s successfully (%d chunks)\n", entry.Name, index)
 	return nil
 }
 
-func receiveFile(rw *bufio.ReadWriter) error {
-	metadata, err := rw.ReadString('\n')
+// awaitAck reads the client's acknowledgement for chunk index and checks
+// that its running digest matches what was sent.
+func awaitAck(codec *wire.Codec, index uint64, chain []byte) error {
+	ack, err := wire.Expect[*wire.Ack](codec)
 	if err != nil {
-		return fmt.Errorf("failed to read metadata: %w", err)
+		return fmt.Errorf("failed to read acknowledgement: %w", err)
 	}
 
-	metadata = strings.TrimSpace(metadata)
-	parts := strings.Split(metadata, "|")
-	if len(parts) != 3 {
-		return fmt.Errorf("invalid metadata format")
+	if ack.Index != index || !bytes.Equal(ack.Chain, chain) {
+		codec.WriteMessage(&wire.Error{Message: "acknowledgement does not match sent data"})
+		return fmt.Errorf("client acknowledged chunk %d with a mismatching digest", ack.Index)
 	}
 
-	fileName := parts[0]
-	originalSize, err := strconv.ParseInt(parts[1], 10, 64)
+	return nil
+}
+
+// receiveOptions controls where and how the client stores what it receives.
+type receiveOptions struct {
+	dir              string         // directory the file is saved in
+	resume           bool           // continue an earlier partial download
+	existing         existingPolicy // what to do if the file name is already taken
+	output           outputMode     // save files or only show them
+	clipboardTimeout time.Duration  // how long a secret stays in the clipboard
+	command          []string       // what to run with outputExec
+}
+
+func receiveFiles(s network.Stream, host *auth.Result, opts receiveOptions) error {
+	codec := wire.NewCodec(s)
+
+	offer, err := wire.Expect[*wire.Offer](codec)
 	if err != nil {
-		return fmt.Errorf("invalid file size: %w", err)
+		return fmt.Errorf("failed to read offer: %w", err)
+	}
+
+	if err := verifyOffer(offer, host.Cipher); err != nil {
+		codec.WriteMessage(&wire.Reject{Reason: "offer signature is invalid"})
+		return err
+	}
+
+	if err := validateOffer(offer); err != nil {
+		codec.WriteMessage(&wire.Reject{Reason: "offer is not acceptable"})
+		return err
 	}
 
-	if !promptFileAcceptance(fileName, originalSize) {
-		rw.WriteString("REJECT\n")
-		rw.Flush()
+	// Entries that can't be received here are shown with the reason and
+	// can't be picked.
+	outputPaths := make([]string, len(offer.Entries))
+	skipped := make([]string, len(offer.Entries))
+	var available int
+	for i, entry := range offer.Entries {
+		switch {
+		case opts.output != outputFiles && entry.Format != wire.FormatFile:
+			skipped[i] = "directories can only be saved"
+		case opts.output != outputFiles && entry.Size > maxSecretSize:
+			skipped[i] = "too large to keep in memory"
+		case opts.output == outputFiles:
+			// Unless the policy allows renaming or overwriting, names that
+			// are already taken are skipped.
+			outputPaths[i], err = chooseOutputPath(opts.dir, entry.Name, opts.existing)
+			if err != nil {
+				log.Println(err)
+				skipped[i] = "already exists"
+			}
+		}
+		if skipped[i] == "" {
+			available++
+		}
+	}
+	if available == 0 {
+		codec.WriteMessage(&wire.Reject{Reason: "none of the files can be received"})
+		return fmt.Errorf("none of the offered files can be received")
+	}
+
+	// The clipboard holds a single secret, a command is run with one.
+	limit := 0
+	if opts.output == outputClipboard || opts.output == outputExec {
+		limit = 1
+	}
+
+	selection := promptSelection(offer.Entries, outputPaths, skipped, limit)
+	if len(selection) == 0 {
+		codec.WriteMessage(&wire.Reject{Reason: "declined by user"})
 		log.Println("File transfer rejected by user")
 		return fmt.Errorf("file transfer rejected")
 	}
 
-	rw.WriteString("ACCEPT\n")
-	rw.Flush()
+	if err := codec.WriteMessage(&wire.Select{Entries: selection}); err != nil {
+		return fmt.Errorf("failed to send selection: %w", err)
+	}
+
+	for _, index := range selection {
+		if err := receiveEntry(codec, s, host, offer, index, outputPaths[index], opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateOffer checks what the client needs to know about every entry
+// before anything is written: that its name stays inside the output
+// directory, that the format is one we can read, and that no two entries
+// would end up at the same path.
+func validateOffer(offer *wire.Offer) error {
+	if len(offer.Entries) == 0 {
+		return fmt.Errorf("host offered no files")
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range offer.Entries {
+		// The name is chosen by the host, never let it escape the output directory.
+		if err := validateFileName(entry.Name); err != nil {
+			return err
+		}
+
+		switch entry.Format {
+		case wire.FormatFile, wire.FormatTar, wire.FormatTarZstd:
+		default:
+			return fmt.Errorf("host offered unsupported format %q", entry.Format)
+		}
+
+		if names[entry.Name] {
+			return fmt.Errorf("host offered %s more than once", entry.Name)
+		}
+		names[entry.Name] = true
+	}
+
+	return nil
+}
 
-	log.Println("Receiving encrypted file...")
+// receiveEntry downloads a single selected entry and saves it at outputPath.
+func receiveEntry(codec *wire.Codec, s network.Stream, host *auth.Result, offer *wire.Offer, index uint64, outputPath string, opts receiveOptions) error {
+	entry := &offer.Entries[index]
 
-	encodedData, err := rw.ReadString('\n')
+	part, err := openPartial(opts.dir, s.Conn().RemotePeer().String(), entry, offer.ChunkSize, opts.resume)
 	if err != nil {
-		return fmt.Errorf("failed to receive encrypted file: %w", err)
+		codec.WriteMessage(&wire.Error{Message: "client cannot store transfer"})
+		return err
 	}
+	defer part.Close()
 
-	encodedData = strings.TrimSpace(encodedData)
-	encryptedData, err := base64.StdEncoding.DecodeString(encodedData)
+	if part.Chunks > 0 {
+		log.Printf("Resuming transfer %s from chunk %d (%s already received)\n", entry.TransferID, part.Chunks, formatFileSize(part.Offset))
+	}
+
+	if err := codec.WriteMessage(&wire.Accept{ResumeFrom: part.Chunks, Chain: part.Chain, Entry: index}); err != nil {
+		return fmt.Errorf("failed to accept offer: %w", err)
+	}
+
+	log.Printf("Receiving encrypted %s...\n", entry.Name)
+
+	if err := receiveChunks(codec, part); err != nil {
+		var remote *wire.Error
+		if errors.As(err, &remote) && (remote.Code == wire.CodeExpired || remote.Code == wire.CodeShuttingDown) {
+			// There is nothing left to resume from.
+			part.remove()
+			return err
+		}
+		log.Printf("Transfer interrupted after %s, run again with -resume to continue\n", formatFileSize(part.Offset))
+		return err
+	}
+
+	log.Printf("Received %s of encrypted data, decrypting...\n", formatFileSize(part.Offset))
+
+	ciphertext, err := part.reader()
 	if err != nil {
-		return fmt.Errorf("failed to decode encrypted file: %w", err)
+		return fmt.Errorf("failed to read received data: %w", err)
 	}
 
-	log.Printf("Received %s of encrypted data, decrypting...\n", formatFileSize(int64(len(encryptedData))))
+	if opts.output != outputFiles {
+		err := revealEntry(host.Cipher, ciphertext, entry, opts)
+		part.remove()
+		return err
+	}
 
-	outputPath := filepath.Join(".", fileName)
-	if err := auth.DecryptData(encryptedData, outputPath); err != nil {
+	// Decrypt next to the partial download and only move the result into
+	// place once it matches the digest the host signed.
+	decryptedPath := filepath.Join(opts.dir, ".secretshare-"+entry.TransferID+".out")
+	if err := decryptToFile(host.Cipher, ciphertext, decryptedPath); err != nil {
 		return fmt.Errorf("failed to decrypt file: %w", err)
 	}
 
+	digest, err := fileDigest(decryptedPath)
+	if err != nil {
+		os.Remove(decryptedPath)
+		return fmt.Errorf("failed to hash decrypted file: %w", err)
+	}
+
+	part.remove()
+
+	if !bytes.Equal(digest, entry.Digest) {
+		os.Remove(decryptedPath)
+		return fmt.Errorf("%w: decrypted file does not match the digest signed by the host", errIntegrity)
+	}
+
+	if entry.Format != wire.FormatFile {
+		return saveDirectory(entry, decryptedPath, outputPath, opts)
+	}
+
+	if err := placeFile(decryptedPath, outputPath, opts.existing); err != nil {
+		os.Remove(decryptedPath)
+		return fmt.Errorf("failed to save decrypted file: %w", err)
+	}
+
 	log.Printf("File saved successfully to: %s\n", outputPath)
 	return nil
 }
+
+// saveDirectory unpacks the verified archive at archivePath next to its
+// final location and moves it into place once it is complete.
+func saveDirectory(entry *wire.Entry, archivePath string, outputPath string, opts receiveOptions) error {
+	defer os.Remove(archivePath)
+
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to read decrypted archive: %w", err)
+	}
+	defer archive.Close()
+
+	unpackPath := filepath.Join(opts.dir, ".secretshare-"+entry.TransferID+".dir")
+	os.RemoveAll(unpackPath)
+
+	if err := unpackArchive(archive, entry.Format, unpackPath); err != nil {
+		os.RemoveAll(unpackPath)
+		return fmt.Errorf("failed to unpack directory: %w", err)
+	}
+
+	if err := placeDir(unpackPath, outputPath, opts.existing); err != nil {
+		os.RemoveAll(unpackPath)
+		return fmt.Errorf("failed to save directory: %w", err)
+	}
+
+	log.Printf("Directory saved successfully to: %s\n", outputPath)
+	return nil
+}
+
+// receiveChunks stores chunks until Done, acknowledging each one once it is
+// on disk.
+func receiveChunks(codec *wire.Codec, part *partial) error {
+	for {
+		m, err := codec.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to receive encrypted file: %w", err)
+		}
+
+		switch m := m.(type) {
+		case *wire.Chunk:
+			if err := part.append(m); err != nil {
+				codec.WriteMessage(&wire.Error{Message: err.Error()})
+				return err
+			}
+
+			if err := codec.WriteMessage(&wire.Ack{Index: m.Index, Chain: part.Chain}); err != nil {
+				return fmt.Errorf("failed to acknowledge chunk %d: %w", m.Index, err)
+			}
+		case *wire.Done:
+			if m.Chunks != part.Chunks || !bytes.Equal(m.Chain, part.Chain) {
+				return fmt.Errorf("received data does not match what the host sent")
+			}
+			return nil
+		case *wire.Error:
+			return fmt.Errorf("failed to receive encrypted file: %w", m)
+		default:
+			return fmt.Errorf("failed to receive encrypted file: %w: %s", wire.ErrUnexpectedMessage, m.Type())
+		}
+	}
+}
+
+// decryptToFile streams the plaintext of src into a new file at path. A
+// partially written file is removed if decryption fails.
+func decryptToFile(encryptor auth.Encryptor, src io.Reader, path string) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	err = encryptor.Decrypt(out, src)
+	if closeErr := out.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write decrypted file: %w", closeErr)
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
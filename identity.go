@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/Noah-Wilderom/secretshare/prompt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// An identity is the libp2p key that gives a node the same peer ID, and so
+// the same address, every time it runs. It is stored as a PEM block holding
+// the marshalled key, or salt, nonce and ciphertext if it is protected with
+// a passphrase.
+const (
+	identityBlock          = "SECRETSHARE IDENTITY"
+	encryptedIdentityBlock = "SECRETSHARE ENCRYPTED IDENTITY"
+
+	identitySaltSize = 16
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+)
+
+var errBadPassphrase = errors.New("wrong passphrase or damaged identity file")
+
+// configPath returns where the file called name is kept in the user's
+// config directory, or an empty string if there is none.
+func configPath(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, AppName, name)
+}
+
+// defaultIdentityPath is where the identity is kept unless -identity says
+// otherwise.
+func defaultIdentityPath() string {
+	return configPath("identity.pem")
+}
+
+// createIdentity generates a new Ed25519 key and stores it at path,
+// encrypted if passphrase is not empty.
+func createIdentity(path string, passphrase []byte, force bool) (crypto.PrivKey, error) {
+	if _, err := os.Stat(path); err == nil && !force {
+		return nil, fmt.Errorf("%s already exists, use -force to replace it and get a new peer ID", path)
+	}
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{Type: identityBlock, Bytes: data}
+	if len(passphrase) > 0 {
+		if block, err = encryptIdentity(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Written next to its final place and renamed, so an existing identity
+	// is never left half overwritten.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".identity-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = pem.Encode(tmp, block)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write identity: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadIdentity reads the identity at path. askPassphrase is only called if
+// the identity is encrypted.
+func loadIdentity(path string, askPassphrase func() ([]byte, error)) (crypto.PrivKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s can be read by other users, run 'chmod 600 %s'", path, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not an identity file", path)
+	}
+
+	switch block.Type {
+	case identityBlock:
+	case encryptedIdentityBlock:
+		passphrase, err := askPassphrase()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		if block.Bytes, err = decryptIdentity(block.Bytes, passphrase); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s is not an identity file", path)
+	}
+
+	key, err := crypto.UnmarshalPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+	return key, nil
+}
+
+func identityCipherKey(passphrase []byte, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+}
+
+func encryptIdentity(data []byte, passphrase []byte) (*pem.Block, error) {
+	header := make([]byte, identitySaltSize+chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(header); err != nil {
+		return nil, err
+	}
+	salt, nonce := header[:identitySaltSize], header[identitySaltSize:]
+
+	key, err := identityCipherKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type:  encryptedIdentityBlock,
+		Bytes: aead.Seal(header, nonce, data, nil),
+	}, nil
+}
+
+func decryptIdentity(data []byte, passphrase []byte) ([]byte, error) {
+	if len(data) < identitySaltSize+chacha20poly1305.NonceSizeX {
+		return nil, errBadPassphrase
+	}
+	salt := data[:identitySaltSize]
+	nonce := data[identitySaltSize : identitySaltSize+chacha20poly1305.NonceSizeX]
+	ciphertext := data[identitySaltSize+chacha20poly1305.NonceSizeX:]
+
+	key, err := identityCipherKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errBadPassphrase
+	}
+	return plaintext, nil
+}
+
+// askIdentityPassphrase asks for the passphrase of an encrypted identity.
+func askIdentityPassphrase() ([]byte, error) {
+	return prompt.Password("Passphrase for the identity: ")
+}
+
+// identityCommand runs 'secretshare identity', which creates the identity
+// or shows where it is and which peer ID it stands for.
+func identityCommand(args []string) error {
+	flags := flag.NewFlagSet("identity", flag.ExitOnError)
+	path := flags.String("identity", defaultIdentityPath(), "Identity file to use")
+	passphrase := flags.Bool("passphrase", false, "Protect the new identity with a passphrase (create only)")
+	force := flags.Bool("force", false, "Replace an existing identity, its peer ID changes (create only)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s identity [create|show] [options]\n\n", AppName)
+		fmt.Fprintf(flags.Output(), "The identity gives this node the same peer ID, and so the same address, on every run.\n\n")
+		flags.PrintDefaults()
+	}
+
+	action := "show"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+
+	if *path == "" {
+		return errors.New("no default location for the identity, pass -identity")
+	}
+
+	var key crypto.PrivKey
+	var err error
+
+	switch action {
+	case "create":
+		var secret []byte
+		if *passphrase {
+			if secret, err = askNewPassphrase(); err != nil {
+				return err
+			}
+		}
+		if key, err = createIdentity(*path, secret, *force); err != nil {
+			return err
+		}
+		fmt.Printf("Created identity %s\n", *path)
+	case "show":
+		key, err = loadIdentity(*path, askIdentityPassphrase)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("there is no identity at %s, run '%s identity create' to make one", *path, AppName)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Identity: %s\n", *path)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Peer ID:  %s\n", id)
+	return nil
+}
+
+// askNewPassphrase reads a passphrase twice to make sure it was typed right.
+func askNewPassphrase() ([]byte, error) {
+	passphrase, err := prompt.Password("New passphrase: ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase is empty, leave out -passphrase to store the identity unencrypted")
+	}
+
+	again, err := prompt.Password("Repeat the passphrase: ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	if string(again) != string(passphrase) {
+		return nil, errors.New("the passphrases don't match")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,17 @@
+//go:build insecureseed
+
+package main
+
+import (
+	"io"
+	mrand "math/rand"
+)
+
+// Builds with the insecureseed tag derive the node key from the port number,
+// so tests get the same peer ID on every run. Never use such a build for
+// real secrets.
+func init() {
+	insecureKeySource = func(port int) io.Reader {
+		return mrand.New(mrand.NewSource(int64(port)))
+	}
+}
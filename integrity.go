@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+// errIntegrity is returned when a received file can't be proven to be the one
+// the host picked. main exits with exitIntegrity when it sees it.
+var errIntegrity = errors.New("integrity check failed")
+
+func fileDigest(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readerDigest(f)
+}
+
+func readerDigest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// payloadDigest hashes the plaintext of src.
+func payloadDigest(src *payload) ([]byte, error) {
+	plaintext, err := src.open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer plaintext.Close()
+
+	digest, err := readerDigest(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file: %w", err)
+	}
+	return digest, nil
+}
+
+// digestCache remembers the digest of the latest version of each payload,
+// so a file is only hashed again, or a directory archived again, once it
+// changed.
+type digestCache struct {
+	mu      sync.Mutex
+	digests map[string]cachedDigest // by format, path and name
+}
+
+type cachedDigest struct {
+	version string
+	digest  []byte
+}
+
+func (c *digestCache) get(src *payload) ([]byte, error) {
+	key := src.format + "\x00" + src.path + "\x00" + src.name
+
+	c.mu.Lock()
+	cached, ok := c.digests[key]
+	c.mu.Unlock()
+	if ok && cached.version == src.version {
+		return cached.digest, nil
+	}
+
+	digest, err := payloadDigest(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.digests == nil {
+		c.digests = make(map[string]cachedDigest)
+	}
+	c.digests[key] = cachedDigest{version: src.version, digest: digest}
+	c.mu.Unlock()
+
+	return digest, nil
+}
+
+// signOffer signs the offer, including the digest of every entry, with the
+// host's key.
+func signOffer(offer *wire.Offer, cipher auth.Cipher) error {
+	var err error
+	offer.Signature, err = cipher.Sign(offer.SignedContent())
+	return err
+}
+
+// verifyOffer checks that the offer was signed by the host authenticated
+// during the handshake.
+func verifyOffer(offer *wire.Offer, cipher auth.Cipher) error {
+	if len(offer.Signature) == 0 {
+		return fmt.Errorf("%w: offer is not signed", errIntegrity)
+	}
+	for _, entry := range offer.Entries {
+		if len(entry.Digest) != sha256.Size {
+			return fmt.Errorf("%w: offer has no digest for %s", errIntegrity, entry.Name)
+		}
+	}
+
+	if err := cipher.Verify(offer.SignedContent(), offer.Signature); err != nil {
+		return fmt.Errorf("%w: offer signature: %v", errIntegrity, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func digestOf(t *testing.T, c *digestCache, path string) []byte {
+	t.Helper()
+
+	src, err := newPayload(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := c.get(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestDigestCacheHashesEachVersionOnce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.env")
+	writeFile(t, path, "first")
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	var c digestCache
+	first := digestOf(t, &c, path)
+	if !bytes.Equal(first, mustFileDigest(t, path)) {
+		t.Fatal("digest doesn't match the file")
+	}
+
+	// Same size and modification time: taken from the cache, not the file.
+	writeFile(t, path, "fir5t")
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if got := digestOf(t, &c, path); !bytes.Equal(got, first) {
+		t.Fatal("file was hashed again although it looks unchanged")
+	}
+
+	writeFile(t, path, "second")
+	if got, want := digestOf(t, &c, path), mustFileDigest(t, path); !bytes.Equal(got, want) {
+		t.Fatal("changed file kept its old digest")
+	}
+
+	// A directory gets a new digest once anything in it changes.
+	tree := digestOf(t, &c, dir)
+	if got := digestOf(t, &c, dir); !bytes.Equal(got, tree) {
+		t.Fatal("unchanged directory got another digest")
+	}
+	writeFile(t, filepath.Join(dir, "b.env"), "more")
+	if got := digestOf(t, &c, dir); bytes.Equal(got, tree) {
+		t.Fatal("changed directory kept its old digest")
+	}
+}
+
+func mustFileDigest(t *testing.T, path string) []byte {
+	t.Helper()
+	digest, err := fileDigest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+var (
+	errOfferExpired = errors.New("offer expired")
+	errShuttingDown = errors.New("host shutting down")
+)
+
+// downloadLimits ends the offer after a number of downloads, once it has
+// been up for a while or when the host shuts down. A download counts once
+// every file the client picked has been sent. Downloads in progress are
+// finished when the offer ends.
+type downloadLimits struct {
+	max int // 0 means unlimited
+
+	mu        sync.Mutex
+	active    int
+	completed int
+	ended     error // why the offer ended, nil while it is open
+	finished  chan struct{}
+}
+
+func newDownloadLimits(max int, ttl time.Duration) *downloadLimits {
+	l := &downloadLimits{
+		max:      max,
+		finished: make(chan struct{}),
+	}
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() {
+			l.end(fmt.Errorf("%w: available for %s only", errOfferExpired, ttl))
+		})
+	}
+	return l
+}
+
+// Err returns why the offer ended, wrapping errOfferExpired or
+// errShuttingDown, or nil while it is open.
+func (l *downloadLimits) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ended
+}
+
+// reserve claims one of the remaining downloads. It has to be released
+// whether or not the download completes.
+func (l *downloadLimits) reserve() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ended != nil {
+		return l.ended
+	}
+	if l.max > 0 && l.active+l.completed >= l.max {
+		return fmt.Errorf("%w: the remaining downloads are in progress", errOfferExpired)
+	}
+	l.active++
+	return nil
+}
+
+// release gives back a reservation. A failed download can be tried again,
+// a completed one is used up.
+func (l *downloadLimits) release(completed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if completed {
+		l.completed++
+		if l.max > 0 && l.completed >= l.max && l.ended == nil {
+			l.ended = fmt.Errorf("%w: download limit reached", errOfferExpired)
+		}
+	}
+	l.finishIfIdle()
+}
+
+// end closes the offer to new downloads, unless it already ended.
+func (l *downloadLimits) end(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ended == nil {
+		l.ended = err
+	}
+	l.finishIfIdle()
+}
+
+func (l *downloadLimits) finishIfIdle() {
+	if l.ended == nil || l.active > 0 {
+		return
+	}
+	select {
+	case <-l.finished:
+	default:
+		close(l.finished)
+	}
+}
+
+// Done is closed once the offer ended and the last download finished.
+func (l *downloadLimits) Done() <-chan struct{} {
+	return l.finished
+}
+
+// offerError is the message telling a client why the offer ended.
+func offerError(err error) *wire.Error {
+	code := wire.CodeExpired
+	if errors.Is(err, errShuttingDown) {
+		code = wire.CodeShuttingDown
+	}
+	return &wire.Error{Message: err.Error(), Code: code}
+}
+
+// shredFile overwrites the file with random data before removing it. File
+// systems that copy on write or journal data, and SSDs, may keep the old
+// blocks around regardless, so this is a best effort.
+func shredFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		return fmt.Errorf("failed to overwrite %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to overwrite %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
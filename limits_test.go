@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+func isDone(l *downloadLimits) bool {
+	select {
+	case <-l.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestDownloadLimitsConcurrentReserve(t *testing.T) {
+	for range 100 {
+		l := newDownloadLimits(1, 0)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 2)
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- l.reserve()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		var reserved int
+		for err := range errs {
+			switch {
+			case err == nil:
+				reserved++
+			case !errors.Is(err, errOfferExpired):
+				t.Fatalf("reserve: %v", err)
+			}
+		}
+		if reserved != 1 {
+			t.Fatalf("%d of 2 concurrent reservations succeeded with a limit of 1", reserved)
+		}
+	}
+}
+
+func TestDownloadLimitsRelease(t *testing.T) {
+	l := newDownloadLimits(1, 0)
+
+	if err := l.reserve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.reserve(); !errors.Is(err, errOfferExpired) {
+		t.Fatalf("second reservation: got %v, want %v", err, errOfferExpired)
+	}
+
+	// A failed download frees its slot.
+	l.release(false)
+	if err := l.Err(); err != nil {
+		t.Fatalf("offer ended after a failed download: %v", err)
+	}
+	if err := l.reserve(); err != nil {
+		t.Fatalf("reserving a released slot: %v", err)
+	}
+
+	l.release(true)
+	if err := l.Err(); !errors.Is(err, errOfferExpired) {
+		t.Fatalf("after the last download: got %v, want %v", err, errOfferExpired)
+	}
+	if err := l.reserve(); !errors.Is(err, errOfferExpired) {
+		t.Fatalf("reserving after the last download: got %v, want %v", err, errOfferExpired)
+	}
+	if !isDone(l) {
+		t.Fatal("not done after the last download")
+	}
+}
+
+func TestDownloadLimitsEndWaitsForDownloads(t *testing.T) {
+	l := newDownloadLimits(0, 0)
+	for range 3 {
+		if err := l.reserve(); err != nil {
+			t.Fatalf("unlimited offer: %v", err)
+		}
+	}
+
+	l.end(errShuttingDown)
+	l.end(errOfferExpired)
+	if err := l.Err(); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("got %v, want the first reason %v", err, errShuttingDown)
+	}
+	if err := l.reserve(); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("reserving after the end: got %v, want %v", err, errShuttingDown)
+	}
+
+	for range 2 {
+		l.release(true)
+		if isDone(l) {
+			t.Fatal("done while a download is in progress")
+		}
+	}
+	l.release(false)
+	if !isDone(l) {
+		t.Fatal("not done after the last download finished")
+	}
+}
+
+func TestDownloadLimitsExpire(t *testing.T) {
+	l := newDownloadLimits(0, 10*time.Millisecond)
+
+	select {
+	case <-l.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("offer did not expire")
+	}
+	if err := l.reserve(); !errors.Is(err, errOfferExpired) {
+		t.Fatalf("got %v, want %v", err, errOfferExpired)
+	}
+	if code := offerError(l.Err()).Code; code != wire.CodeExpired {
+		t.Fatalf("expired offer reported with code %d", code)
+	}
+	if code := offerError(errShuttingDown).Code; code != wire.CodeShuttingDown {
+		t.Fatalf("shutdown reported with code %d", code)
+	}
+}
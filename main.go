@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 
 	"github.com/Noah-Wilderom/secretshare/auth"
-	"golang.design/x/clipboard"
+	"github.com/Noah-Wilderom/secretshare/prompt"
+	"github.com/Noah-Wilderom/secretshare/wire"
 
-	"io"
 	"log"
-	mrand "math/rand"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 const (
@@ -20,28 +24,188 @@ const (
 	AppVersion = "1.0.0"
 )
 
-func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+const (
+	exitFailure   = 1
+	exitIntegrity = 3
+	exitExpired   = 4
+)
+
+// fileList collects the paths of repeated -file flags.
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *fileList) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
+// checkNames makes sure no two shared paths, nor a path and one of the
+// extra names, reach the client under the same name.
+func (f fileList) checkNames(extra ...string) error {
+	names := make(map[string]string)
+	for _, name := range extra {
+		names[name] = "the secret"
+	}
+	for _, path := range f {
+		name := filepath.Base(path)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s and %s would both be sent as %s", other, path, name)
+		}
+		names[name] = path
+	}
+	return nil
+}
+
+// flagSet reports whether the flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// defaultSSHKeyPath is the key ssh itself uses for ed25519.
+func defaultSSHKeyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "id_ed25519")
+}
+
+// parseEncryptions reads the comma separated list of -encrypt.
+func parseEncryptions(list string) ([]string, error) {
+	var encryptions []string
+	for _, encryption := range strings.Split(list, ",") {
+		encryption = strings.TrimSpace(encryption)
+		if encryption != auth.EncryptionGPG && encryption != auth.EncryptionAge {
+			return nil, fmt.Errorf("unknown encryption %q, use %s or %s", encryption, auth.EncryptionGPG, auth.EncryptionAge)
+		}
+		encryptions = append(encryptions, encryption)
+	}
+	return encryptions, nil
+}
+
+// sharedPassword returns the password of a PAKE handshake: the pairing
+// code if there is one, otherwise what the environment or the user says.
+func sharedPassword(isHost bool, code *pairingCode) ([]byte, error) {
+	if code != nil {
+		return []byte(code.String()), nil
+	}
+	if password := os.Getenv(auth.PasswordEnv); password != "" {
+		return []byte(password), nil
+	}
+
+	if !isHost {
+		password, err := prompt.Password("Password: ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %w", err)
+		}
+		if len(password) == 0 {
+			return nil, errors.New("the password is empty")
+		}
+		return password, nil
+	}
 
-	err := clipboard.Init()
+	password, err := prompt.Password("Password the client has to enter: ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+	if len(password) == 0 {
+		return nil, errors.New("the password is empty, add -code to get one made up")
+	}
+	again, err := prompt.Password("Repeat the password: ")
 	if err != nil {
-		log.Printf("Warning: Clipboard unavailable: %v\n", err)
-		log.Println("Clipboard functionality will be disabled, but file transfer will work normally.")
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+	if string(again) != string(password) {
+		return nil, errors.New("the passwords don't match")
 	}
+	return password, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"identity": identityCommand,
+			"peers":    peersCommand,
+		}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	sourcePort := flag.Int("sp", 0, "Source port number")
-	dest := flag.String("d", "", "Destination multiaddr string")
-	filePath := flag.String("file", "", "Path to file to share (host only)")
+	dest := flag.String("d", "", "Destination multiaddr string, or the host's pairing code")
+	var filePaths fileList
+	flag.Var(&filePaths, "file", "Path to file or directory to share, repeat to share several (host only)")
+	compress := flag.Bool("compress", false, "Compress shared directories with zstd (host only)")
+	fromStdin := flag.Bool("stdin", false, "Share a secret read from stdin, it is kept in memory only (host only)")
+	text := flag.String("text", "", "Share this text as a secret, kept in memory only (host only)")
+	secretName := flag.String("name", defaultSecretName, "Name to offer a -stdin or -text secret under (host only)")
+	maxDownloads := flag.Int("max-downloads", 0, "Stop sharing after this many downloads, 0 means unlimited (default 1 with -stdin or -text) (host only)")
+	expire := flag.Duration("expire", 0, "Stop sharing after this long, e.g. 10m (host only)")
+	withCode := flag.Bool("code", false, "Also advertise on the local network under a short pairing code (host only)")
+	shred := flag.Bool("shred", false, "Overwrite and delete the shared files once sharing stops because of -max-downloads or -expire (host only)")
+	resume := flag.Bool("resume", false, "Continue an interrupted download from the same host (client only)")
+	outDir := flag.String("out", ".", "Directory to save the received file in (client only)")
+	rename := flag.Bool("rename", false, "Save under a new name if the file already exists (client only)")
+	force := flag.Bool("force", false, "Overwrite the file if it already exists (client only)")
+	toStdout := flag.Bool("stdout", false, "Write received files to stdout instead of saving them (client only)")
+	printSecret := flag.Bool("print", false, "Show received text files on the terminal instead of saving them (client only)")
+	toClipboard := flag.Bool("clipboard", false, "Copy a received text file to the clipboard instead of saving it (client only)")
+	clipboardTimeout := flag.Duration("clipboard-timeout", defaultClipboardTimeout, "Clear the clipboard after this long (client only)")
+	execCommand := flag.Bool("exec", false, "Run the command after -- with the received dotenv file as environment variables (client only)")
+	authMode := flag.String("auth", auth.ModeGPG, "How the two sides authenticate: gpg (keys), ssh (ssh-ed25519 keys) or pake (a shared password, the default with pairing codes)")
+	sshKey := flag.String("ssh-key", defaultSSHKeyPath(), "SSH private key to authenticate with (ssh only)")
+	allowedSigners := flag.String("allowed-signers", "", "authorized_keys or allowed_signers file of SSH keys to accept without asking (host only, ssh only)")
+	policyPath := flag.String("policy", "", "YAML file of rules to allow, deny or prompt for clients, instead of asking about each (host only, gpg only)")
+	encryptions := flag.String("encrypt", auth.EncryptionAge+","+auth.EncryptionGPG, "Encryptions to pick from when the client supports them, in order of preference: gpg, age (host only)")
+	ageIdentity := flag.String("age-identity", "", "age identity file or ssh-ed25519 private key to receive age encrypted files with (client only)")
+	pgpBackend := flag.String("pgp", auth.BackendGPG, "OpenPGP implementation to use: gpg (system binary) or native")
+	pgpKeys := flag.String("pgp-keys", "", "Armored secret key file or directory of key files (native backend only)")
+	identityPath := flag.String("identity", defaultIdentityPath(), "Identity that gives the node the same address on every run, see 'identity' (used by the host unless given)")
+	knownPeersPath := flag.String("known-peers", defaultKnownPeersPath(), "File the trusted hosts are remembered in, empty to not remember them (client only)")
+	strictPeers := flag.Bool("strict-peers", false, "Refuse hosts that don't match known peers instead of warning (client only)")
 	help := flag.Bool("help", false, "Display help")
-	debug := flag.Bool("debug", false, "Debug generates the same node ID on every execution")
 
 	flag.Parse()
 
 	if *help {
 		fmt.Printf("Share secrets through P2P connection\n\n")
 		fmt.Printf("Host Usage: Run '%s -sp <SOURCE_PORT> -file <FILE_PATH>' to share a file.\n", AppName)
+		fmt.Printf("            Repeat '-file' to share several files, the client picks which ones to download.\n")
+		fmt.Printf("            A directory is sent as a tar archive, add '-compress' to compress it.\n")
+		fmt.Printf("            Use '-stdin' or '-text <TEXT>' instead of '-file' to share a secret without a file.\n")
+		fmt.Printf("            Add '-max-downloads <N>' or '-expire <DURATION>' to stop sharing, '-shred' to delete the files then.\n")
+		fmt.Printf("            Add '-code' to get a short pairing code the client can use on the local network.\n")
+		fmt.Printf("            Without GPG keys, add '-auth ssh' on both sides to use SSH keys, or '-auth pake' for a shared password.\n")
+		fmt.Printf("            With '-auth ssh', '-allowed-signers <FILE>' accepts the keys listed in it without asking.\n")
+		fmt.Printf("            Add '-policy <FILE>' to allow or deny clients by fingerprint or user ID without asking.\n")
+		fmt.Printf("            Run '%s identity create' once to keep the same address on every run.\n", AppName)
 		fmt.Printf("Client Usage: Run '%s -d <MULTIADDR>' to connect and receive the file.\n", AppName)
+		fmt.Printf("              On the local network '-d <PAIRING_CODE>' works too, like '-d 7-crossbow-pilot'.\n")
+		fmt.Printf("              Add '-resume' to continue a download that was interrupted.\n")
+		fmt.Printf("              Trusted hosts are remembered, run '%s peers' to list or forget them.\n", AppName)
+		fmt.Printf("              Add '-out <DIR>' to save somewhere else than the current directory.\n")
+		fmt.Printf("              Existing files are never replaced unless '-force' is given, '-rename' keeps both.\n")
+		fmt.Printf("              Add '-stdout' or '-print' to output the secret instead of saving it.\n")
+		fmt.Printf("              Add '-clipboard' to copy it to the clipboard, it is cleared after '-clipboard-timeout'.\n")
+		fmt.Printf("              Add '-age-identity <FILE>' to receive files encrypted with age instead of GPG.\n")
+		fmt.Printf("              Add '-exec -- <COMMAND>' to run a command with a dotenv secret as its environment.\n")
 		fmt.Printf("\nExample:\n")
 		fmt.Printf("  Host:   %s -sp 8080 -file /path/to/secret.txt\n", AppName)
 		fmt.Printf("  Client: %s -d /ip4/127.0.0.1/tcp/8080/p2p/<PEER_ID>\n", AppName)
@@ -50,31 +214,282 @@ func main() {
 	}
 
 	isHost := *dest == ""
-	if isHost && *filePath == "" {
-		fmt.Printf("Error: Host mode requires a file to share. Use -file flag.\n")
+
+	if isHost {
+		// The first signal lets the host finish what it is sending, a
+		// second one kills it right away.
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		context.AfterFunc(ctx, stop)
+	}
+
+	var err error
+	send := sendOptions{filePaths: filePaths, compress: *compress, secretName: *secretName}
+	switch {
+	case *fromStdin && *text != "":
+		fmt.Printf("Error: -stdin and -text can't be used together.\n")
+		os.Exit(1)
+	case *fromStdin:
+		send.secret, err = readSecret(os.Stdin)
+		if err != nil {
+			fmt.Printf("Error: Failed to read secret from stdin: %v\n", err)
+			os.Exit(1)
+		}
+		if len(send.secret) == 0 {
+			fmt.Printf("Error: The secret read from stdin is empty.\n")
+			os.Exit(1)
+		}
+
+		// stdin is used up, questions have to go to the terminal.
+		tty, err := prompt.Terminal()
+		if err != nil {
+			fmt.Printf("Error: -stdin needs a terminal to ask for confirmation: %v\n", err)
+			os.Exit(1)
+		}
+		defer tty.Close()
+		prompt.Use(tty, tty)
+	case *text != "":
+		send.secret = []byte(*text)
+	}
+
+	if isHost && len(filePaths) == 0 && send.secret == nil {
+		fmt.Printf("Error: Host mode requires a file to share. Use -file, -stdin or -text.\n")
 		fmt.Printf("Run '%s -help' for usage information.\n", AppName)
 		os.Exit(1)
 	}
+	send.maxDownloads, send.expire, send.shred = *maxDownloads, *expire, *shred
+	if send.secret != nil && !flagSet("max-downloads") {
+		// Secrets are burned after reading unless asked otherwise.
+		send.maxDownloads = 1
+	}
+	if err := send.checkLimits(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var extraNames []string
+	if send.secret != nil {
+		if err := validateFileName(*secretName); err != nil {
+			fmt.Printf("Error: -name: %v\n", err)
+			os.Exit(1)
+		}
+		extraNames = append(extraNames, *secretName)
+	}
+	if err := filePaths.checkNames(extraNames...); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	receive := receiveOptions{dir: *outDir, resume: *resume, clipboardTimeout: *clipboardTimeout}
+	switch {
+	case *rename && *force:
+		fmt.Printf("Error: -rename and -force can't be used together.\n")
+		os.Exit(1)
+	case *rename:
+		receive.existing = renameExisting
+	case *force:
+		receive.existing = overwriteExisting
+	}
+
+	outputs := 0
+	for _, set := range []bool{*toStdout, *printSecret, *toClipboard, *execCommand} {
+		if set {
+			outputs++
+		}
+	}
+
+	switch {
+	case outputs > 1:
+		fmt.Printf("Error: Only one of -stdout, -print, -clipboard and -exec can be used.\n")
+		os.Exit(1)
+	case *toStdout:
+		receive.output = outputStdout
+		// Keep stdout clean for the secret.
+		prompt.Use(os.Stdin, os.Stderr)
+	case *printSecret:
+		receive.output = outputPrint
+	case *toClipboard:
+		receive.output = outputClipboard
+		if *clipboardTimeout <= 0 {
+			fmt.Printf("Error: -clipboard-timeout must be positive.\n")
+			os.Exit(1)
+		}
+		if err := initClipboard(); err != nil {
+			fmt.Printf("Error: -clipboard: %v\n", err)
+			os.Exit(1)
+		}
+	case *execCommand:
+		receive.output = outputExec
+		receive.command = flag.Args()
+		if len(receive.command) == 0 {
+			fmt.Printf("Error: -exec needs a command after --, like '-exec -- ./deploy.sh'.\n")
+			os.Exit(1)
+		}
+	}
+
+	if len(flag.Args()) > 0 && receive.output != outputExec {
+		fmt.Printf("Error: Unexpected arguments %q, only -exec runs a command.\n", flag.Args())
+		os.Exit(1)
+	}
+	if isHost && receive.output != outputFiles {
+		fmt.Printf("Error: -stdout, -print, -clipboard and -exec are only used when receiving with -d.\n")
+		os.Exit(1)
+	}
+
+	if !isHost {
+		if info, err := os.Stat(*outDir); err != nil || !info.IsDir() {
+			fmt.Printf("Error: Output directory %s does not exist.\n", *outDir)
+			os.Exit(1)
+		}
+	}
+
+	// Clients only need a stable address when they ask for one, and a
+	// client sharing the host's identity couldn't connect to it.
+	if !isHost && !flagSet("identity") {
+		*identityPath = ""
+	}
+
+	// Clients remember the hosts they trusted. Hosts get new clients all
+	// the time, most without a persistent identity.
+	var known *auth.KnownPeers
+	if !isHost && *knownPeersPath != "" {
+		known, err = auth.LoadKnownPeers(*knownPeersPath)
+		if err != nil {
+			fmt.Printf("Error: Failed to read known peers: %v\n", err)
+			os.Exit(1)
+		}
+		known.Strict = *strictPeers
+	}
+
+	var code *pairingCode
+	switch {
+	case isHost && *withCode:
+		code, err = newPairingCode()
+		if err == nil {
+			// Before the code becomes the PAKE password below.
+			err = claimNameplate(code)
+		}
+		if err != nil {
+			fmt.Printf("Error: Failed to make a pairing code: %v\n", err)
+			os.Exit(1)
+		}
+	case *withCode:
+		fmt.Printf("Error: -code is only used by the host, pass the code to -d instead.\n")
+		os.Exit(1)
+	case isPairingCode(*dest):
+		code, err = parsePairingCode(*dest)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	p := NewPeer(*sourcePort, *identityPath, known, code)
 
-	var r io.Reader
-	if *debug {
-		// Use the port number as the randomness source.
-		// This will always generate the same host ID on multiple executions, if the same port number is used.
-		// Never do this in production code.
-		r = mrand.New(mrand.NewSource(int64(*sourcePort)))
-	} else {
-		r = rand.Reader
+	if code != nil && !flagSet("auth") {
+		// The code is a password both sides already have.
+		*authMode = auth.ModePAKE
 	}
 
-	p := NewPeer(*sourcePort, r)
+	// Ignoring these would leave a host meant to run unattended prompting,
+	// or accepting whoever has the password.
+	if *policyPath != "" && *authMode != auth.ModeGPG {
+		fmt.Printf("Error: -policy only works with '-auth %s', not %s.\n", auth.ModeGPG, *authMode)
+		os.Exit(1)
+	}
+	if *allowedSigners != "" && *authMode != auth.ModeSSH {
+		fmt.Printf("Error: -allowed-signers only works with '-auth %s', not %s.\n", auth.ModeSSH, *authMode)
+		os.Exit(1)
+	}
+
+	var handshaker auth.Handshaker
+	switch *authMode {
+	case auth.ModeGPG:
+		// Peer keys live in a keyring private to the backend that is wiped when the server disconnects.
+		backend, err := auth.NewBackend(*pgpBackend, *pgpKeys)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		// Determine if we're the host (listener) or client (connector)
+		gpg := auth.NewGPGHandshake(isHost, backend, known)
+		gpg.Encryptions, err = parseEncryptions(*encryptions)
+		if err != nil {
+			backend.Close()
+			fmt.Printf("Error: -encrypt: %v\n", err)
+			os.Exit(1)
+		}
+		if !isHost && *ageIdentity != "" {
+			gpg.AgeIdentity, err = auth.LoadAgeIdentity(*ageIdentity)
+			if err != nil {
+				backend.Close()
+				fmt.Printf("Error: Failed to load age identity: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if isHost && *policyPath != "" {
+			gpg.Policy, err = auth.LoadPolicy(*policyPath)
+			if err != nil {
+				backend.Close()
+				fmt.Printf("Error: Failed to read policy: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		handshaker = gpg
+	case auth.ModeSSH:
+		key, err := auth.LoadSSHKey(*sshKey)
+		if err != nil {
+			fmt.Printf("Error: Failed to load SSH key: %v\n", err)
+			os.Exit(1)
+		}
+
+		var allowed *auth.AllowedSigners
+		if isHost && *allowedSigners != "" {
+			allowed, err = auth.LoadAllowedSigners(*allowedSigners)
+			if err != nil {
+				fmt.Printf("Error: Failed to read allowed signers: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		handshaker = auth.NewSSHHandshake(isHost, key, allowed, known)
+	case auth.ModePAKE:
+		password, err := sharedPassword(isHost, code)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		handshaker = auth.NewPAKEHandshake(isHost, password)
+	default:
+		fmt.Printf("Error: Unknown -auth mode %q, use %s, %s or %s.\n", *authMode, auth.ModeGPG, auth.ModeSSH, auth.ModePAKE)
+		os.Exit(1)
+	}
 
-	// Determine if we're the host (listener) or client (connector)
-	handshaker := auth.NewGPGHandshake(isHost)
+	s, err := NewServer(p, *dest, send, receive, handshaker)
+	if err != nil {
+		if c, ok := handshaker.(io.Closer); ok {
+			c.Close()
+		}
+		log.Fatalln(err)
+	}
+
+	err = s.Start(ctx)
+
+	if err != nil {
+		var exit *commandExit
+		if errors.As(err, &exit) {
+			os.Exit(exit.code)
+		}
 
-	s := NewServer(p, *dest, *filePath, handshaker)
+		var remote *wire.Error
+		if errors.As(err, &remote) && remote.Code == wire.CodeExpired {
+			log.Printf("The host no longer shares its files (%s)\n", remote.Message)
+			os.Exit(exitExpired)
+		}
 
-	if err := s.Start(ctx); err != nil {
 		log.Println(err)
-		return
+		if errors.Is(err, errIntegrity) {
+			os.Exit(exitIntegrity)
+		}
+		os.Exit(exitFailure)
 	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFileNameLength is the longest name, in bytes, we accept from a host.
+// Most file systems cap a single path element at 255 bytes.
+const maxFileNameLength = 255
+
+var errUnsafeName = errors.New("unsafe file name")
+
+// validateFileName checks that name, as offered by the remote host, is a
+// plain file name we can create inside the output directory. It must not be
+// able to point anywhere else, so separators of any platform, "." and ".."
+// are rejected. So are control and format characters, which could mess up
+// the terminal or, like right-to-left overrides, disguise the extension.
+func validateFileName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: empty name", errUnsafeName)
+	case len(name) > maxFileNameLength:
+		return fmt.Errorf("%w: name is %d bytes long, at most %d allowed", errUnsafeName, len(name), maxFileNameLength)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("%w: name is not valid UTF-8", errUnsafeName)
+	case name == "." || name == "..":
+		return fmt.Errorf("%w: %q", errUnsafeName, name)
+	case strings.ContainsAny(name, `/\:`):
+		return fmt.Errorf("%w: %q contains a path separator", errUnsafeName, name)
+	case strings.ContainsFunc(name, isHiddenRune):
+		return fmt.Errorf("%w: %q contains control characters", errUnsafeName, name)
+	}
+	return nil
+}
+
+func isHiddenRune(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Cf, r)
+}
+
+// existingPolicy decides what happens when the received file's name is
+// already taken in the output directory.
+type existingPolicy int
+
+const (
+	refuseExisting    existingPolicy = iota // fail without touching the existing file
+	renameExisting                          // save under the first free "name (n).ext"
+	overwriteExisting                       // replace the existing file
+)
+
+// maxRenameAttempts bounds the search for a free name under renameExisting.
+const maxRenameAttempts = 1000
+
+// chooseOutputPath picks the path the file called name is saved to inside dir.
+func chooseOutputPath(dir string, name string, policy existingPolicy) (string, error) {
+	path := filepath.Join(dir, name)
+
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check output path: %w", err)
+	}
+
+	switch policy {
+	case overwriteExisting:
+		if info.IsDir() {
+			return "", fmt.Errorf("%s is a directory", path)
+		}
+		return path, nil
+	case renameExisting:
+		stem, ext := splitExt(name)
+		for n := 1; n <= maxRenameAttempts; n++ {
+			candidate := filepath.Join(dir, stem+" ("+strconv.Itoa(n)+")"+ext)
+			if _, err := os.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+				return candidate, nil
+			}
+		}
+		return "", fmt.Errorf("no free name for %s in %s", name, dir)
+	default:
+		return "", fmt.Errorf("%s already exists, use -rename to keep both or -force to overwrite", path)
+	}
+}
+
+// splitExt splits name into stem and extension, treating a leading dot as
+// part of the stem so ".env" stays ".env (1)" rather than " (1).env".
+func splitExt(name string) (string, string) {
+	ext := filepath.Ext(name)
+	if ext == name {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
+
+// placeFile moves the finished file at tmp to path. Unless the policy allows
+// overwriting, a file that appeared at path in the meantime is left alone.
+func placeFile(tmp string, path string, policy existingPolicy) error {
+	if policy == overwriteExisting {
+		return os.Rename(tmp, path)
+	}
+
+	// A hard link fails if path exists, which makes the check atomic.
+	err := os.Link(tmp, path)
+	if err == nil {
+		return os.Remove(tmp)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s was created while the transfer was running", path)
+	}
+
+	// Some file systems don't support hard links.
+	if _, statErr := os.Lstat(path); !errors.Is(statErr, os.ErrNotExist) {
+		return fmt.Errorf("%s was created while the transfer was running", path)
+	}
+	return os.Rename(tmp, path)
+}
+
+// placeDir moves the unpacked directory at tmp to path. Existing directories
+// are never merged into or replaced, with overwriteExisting only a file in
+// the way is removed.
+func placeDir(tmp string, path string, policy existingPolicy) error {
+	info, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case policy == overwriteExisting && !info.IsDir():
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateFileName(t *testing.T) {
+	valid := []string{"a.env", ".env", "..env", "secret", "naïve.txt", "file name (1).txt", strings.Repeat("a", maxFileNameLength)}
+	for _, name := range valid {
+		if err := validateFileName(name); err != nil {
+			t.Errorf("validateFileName(%q) = %v, want nil", name, err)
+		}
+	}
+
+	invalid := []string{
+		"", ".", "..", "../x", "a/b", `a\b`, "C:x", "/etc/passwd",
+		"a\x00b", "a\nb", "evil‮txt.exe", "\xff",
+		strings.Repeat("a", maxFileNameLength+1),
+	}
+	for _, name := range invalid {
+		if err := validateFileName(name); err == nil {
+			t.Errorf("validateFileName(%q) = nil, want an error", name)
+		}
+	}
+}
+
+func FuzzValidateFileName(f *testing.F) {
+	for _, seed := range []string{"a.env", ".", "..", "../x", "a/b", `a\b`, "C:x", "a\x00b", "‮", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		if validateFileName(name) != nil {
+			return
+		}
+
+		dir := filepath.Join("out", "dir")
+		joined := filepath.Join(dir, name)
+		if filepath.Dir(joined) != dir || filepath.Base(joined) != name {
+			t.Fatalf("%q passed validation but joins to %q, outside %q", name, joined, dir)
+		}
+	})
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestChooseOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.env"), "old")
+	writeFile(t, filepath.Join(dir, "a (1).env"), "old")
+	writeFile(t, filepath.Join(dir, ".env"), "old")
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		policy existingPolicy
+		want   string // empty for an error
+	}{
+		{"new.txt", refuseExisting, "new.txt"},
+		{"a.env", refuseExisting, ""},
+		{"a.env", renameExisting, "a (2).env"},
+		{".env", renameExisting, ".env (1)"},
+		{"a.env", overwriteExisting, "a.env"},
+		{"sub", overwriteExisting, ""},
+	}
+	for _, tt := range tests {
+		got, err := chooseOutputPath(dir, tt.name, tt.policy)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("chooseOutputPath(%q, %d) = %q, want an error", tt.name, tt.policy, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.Join(dir, tt.want) {
+			t.Errorf("chooseOutputPath(%q, %d) = %q, %v, want %q", tt.name, tt.policy, got, err, tt.want)
+		}
+	}
+}
+
+func TestPlaceFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.env")
+
+	tmp := filepath.Join(dir, "tmp1")
+	writeFile(t, tmp, "first")
+	if err := placeFile(tmp, path, refuseExisting); err != nil {
+		t.Fatalf("placeFile to a free path: %v", err)
+	}
+	if got := readFile(t, path); got != "first" {
+		t.Fatalf("placed file holds %q", got)
+	}
+	if _, err := os.Lstat(tmp); !os.IsNotExist(err) {
+		t.Fatal("placeFile left the temporary file behind")
+	}
+
+	// A file that appeared at path during the transfer is left alone.
+	tmp = filepath.Join(dir, "tmp2")
+	writeFile(t, tmp, "second")
+	for _, policy := range []existingPolicy{refuseExisting, renameExisting} {
+		if err := placeFile(tmp, path, policy); err == nil {
+			t.Fatalf("placeFile with policy %d replaced an existing file", policy)
+		}
+		if got := readFile(t, path); got != "first" {
+			t.Fatalf("existing file now holds %q", got)
+		}
+	}
+
+	if err := placeFile(tmp, path, overwriteExisting); err != nil {
+		t.Fatalf("placeFile with -force: %v", err)
+	}
+	if got := readFile(t, path); got != "second" {
+		t.Fatalf("overwritten file holds %q", got)
+	}
+}
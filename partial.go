@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+// partialState is persisted next to the encrypted chunks of an unfinished
+// transfer so a later run with -resume can pick up where this one stopped.
+type partialState struct {
+	TransferID string `json:"transfer_id"`
+	Host       string `json:"host"`
+	Name       string `json:"name"`
+	ChunkSize  uint64 `json:"chunk_size"`
+	Chunks     uint64 `json:"chunks"`
+	Offset     int64  `json:"offset"`
+	Chain      []byte `json:"chain"`
+}
+
+// partial is the receiver's copy of an in-progress transfer: the encrypted
+// chunks received so far plus the state describing them.
+type partial struct {
+	partialState
+	dir  string
+	file *os.File
+}
+
+func partialPaths(dir string, transferID string) (data string, state string) {
+	base := filepath.Join(dir, ".secretshare-"+transferID)
+	return base + ".part", base + ".json"
+}
+
+// openPartial prepares storage for the transfer of entry. With resume set it
+// reuses an earlier partial download after re-verifying every stored chunk
+// against the recorded chain; otherwise, or if verification fails, it starts
+// from scratch.
+func openPartial(dir string, host string, entry *wire.Entry, chunkSize uint64, resume bool) (*partial, error) {
+	if entry.TransferID == "" || filepath.Base(entry.TransferID) != entry.TransferID {
+		return nil, fmt.Errorf("invalid transfer ID %q", entry.TransferID)
+	}
+	if chunkSize == 0 || chunkSize > wire.MaxPayloadSize/2 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	p := &partial{
+		partialState: partialState{
+			TransferID: entry.TransferID,
+			Host:       host,
+			Name:       entry.Name,
+			ChunkSize:  chunkSize,
+		},
+		dir: dir,
+	}
+
+	dataPath, _ := partialPaths(dir, entry.TransferID)
+
+	if resume {
+		ok, err := p.restore(host, entry.TransferID, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return p, nil
+		}
+	}
+
+	file, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create partial file: %w", err)
+	}
+	p.file = file
+
+	return p, p.save()
+}
+
+func (p *partial) restore(host string, transferID string, chunkSize uint64) (bool, error) {
+	dataPath, statePath := partialPaths(p.dir, transferID)
+
+	raw, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read partial state: %w", err)
+	}
+
+	var state partialState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return false, fmt.Errorf("failed to parse partial state: %w", err)
+	}
+
+	if state.TransferID != transferID || state.Host != host || state.ChunkSize != chunkSize {
+		return false, nil
+	}
+
+	file, err := os.OpenFile(dataPath, os.O_RDWR, 0600)
+	if err != nil {
+		return false, nil
+	}
+
+	// Everything past the last acknowledged chunk may be a torn write.
+	if err := file.Truncate(state.Offset); err != nil {
+		file.Close()
+		return false, fmt.Errorf("failed to truncate partial file: %w", err)
+	}
+
+	chain, err := chainOf(file, state.ChunkSize, state.Chunks)
+	if err != nil || !bytes.Equal(chain, state.Chain) {
+		file.Close()
+		return false, nil
+	}
+
+	if _, err := file.Seek(state.Offset, io.SeekStart); err != nil {
+		file.Close()
+		return false, err
+	}
+
+	p.partialState = state
+	p.file = file
+	return true, nil
+}
+
+// chainOf recomputes the running digest over the first n chunks of r.
+func chainOf(r io.ReaderAt, chunkSize uint64, n uint64) ([]byte, error) {
+	var chain []byte
+	buf := make([]byte, chunkSize)
+	offset := int64(0)
+
+	for i := uint64(0); i < n; i++ {
+		read, err := r.ReadAt(buf, offset)
+		if err != nil && !(errors.Is(err, io.EOF) && read > 0) {
+			return nil, err
+		}
+		chain = wire.Chain(chain, wire.ChunkDigest(buf[:read]))
+		offset += int64(read)
+	}
+
+	return chain, nil
+}
+
+// append verifies chunk and stores it. Chunks must arrive in order.
+func (p *partial) append(chunk *wire.Chunk) error {
+	if chunk.Index != p.Chunks {
+		return fmt.Errorf("got chunk %d, expected %d", chunk.Index, p.Chunks)
+	}
+
+	digest := wire.ChunkDigest(chunk.Data)
+	if !bytes.Equal(digest, chunk.Digest) {
+		return fmt.Errorf("chunk %d failed integrity check", chunk.Index)
+	}
+
+	if _, err := p.file.Write(chunk.Data); err != nil {
+		return fmt.Errorf("failed to store chunk %d: %w", chunk.Index, err)
+	}
+
+	p.Chunks++
+	p.Offset += int64(len(chunk.Data))
+	p.Chain = wire.Chain(p.Chain, digest)
+
+	return p.save()
+}
+
+func (p *partial) save() error {
+	raw, err := json.Marshal(p.partialState)
+	if err != nil {
+		return err
+	}
+
+	_, statePath := partialPaths(p.dir, p.TransferID)
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("failed to save partial state: %w", err)
+	}
+
+	return os.Rename(tmp, statePath)
+}
+
+// reader returns the stored ciphertext from the beginning.
+func (p *partial) reader() (io.Reader, error) {
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return p.file, nil
+}
+
+func (p *partial) Close() error {
+	return p.file.Close()
+}
+
+// remove deletes the partial download once it has been decrypted.
+func (p *partial) remove() {
+	p.file.Close()
+
+	dataPath, statePath := partialPaths(p.dir, p.TransferID)
+	os.Remove(dataPath)
+	os.Remove(statePath)
+}
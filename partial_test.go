@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+const testChunkSize = 16
+
+// writePartial stores chunks as a partial download of entry from host and
+// returns the paths of its data and state.
+func writePartial(t *testing.T, dir string, entry *wire.Entry, chunks ...string) (string, string) {
+	t.Helper()
+
+	part, err := openPartial(dir, "host", entry, testChunkSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+
+	for i, data := range chunks {
+		chunk := &wire.Chunk{Data: []byte(data), Index: uint64(i), Digest: wire.ChunkDigest([]byte(data))}
+		if err := part.append(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return partialPaths(dir, entry.TransferID)
+}
+
+func TestPartialRestore(t *testing.T) {
+	dir := t.TempDir()
+	entry := &wire.Entry{Name: "a.env", TransferID: "t1"}
+	dataPath, _ := writePartial(t, dir, entry, "0123456789abcdef", "0123456789abcdef", "tail")
+
+	// A chunk that was being written when the client died.
+	f, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("torn")
+	f.Close()
+
+	part, err := openPartial(dir, "host", entry, testChunkSize, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.Close()
+
+	if part.Chunks != 3 || part.Offset != 36 {
+		t.Fatalf("restored %d chunks, %d bytes, want 3 and 36", part.Chunks, part.Offset)
+	}
+	if info, err := os.Stat(dataPath); err != nil || info.Size() != 36 {
+		t.Fatalf("partial file not truncated to the acknowledged chunks: %v, %v", info.Size(), err)
+	}
+
+	next := []byte("more")
+	if err := part.append(&wire.Chunk{Data: next, Index: 3, Digest: wire.ChunkDigest(next)}); err != nil {
+		t.Fatalf("append after restore: %v", err)
+	}
+	if got := readFile(t, dataPath); got != "0123456789abcdef0123456789abcdeftailmore" {
+		t.Fatalf("partial file holds %q", got)
+	}
+}
+
+func TestPartialRefusesTamperedState(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(t *testing.T, dataPath, statePath string)
+		host    string
+		wantErr bool
+	}{
+		{"chain", func(t *testing.T, _, statePath string) {
+			editState(t, statePath, func(state *partialState) { state.Chain[0] ^= 1 })
+		}, "host", false},
+		{"more chunks", func(t *testing.T, _, statePath string) {
+			editState(t, statePath, func(state *partialState) { state.Chunks++ })
+		}, "host", false},
+		{"chunk size", func(t *testing.T, _, statePath string) {
+			editState(t, statePath, func(state *partialState) { state.ChunkSize = 8 })
+		}, "host", false},
+		{"data", func(t *testing.T, dataPath, _ string) {
+			writeFile(t, dataPath, "0123456789abcdeX0123456789abcdef")
+		}, "host", false},
+		{"unparsable", func(t *testing.T, _, statePath string) {
+			writeFile(t, statePath, "{")
+		}, "host", true},
+		{"another host", func(*testing.T, string, string) {}, "someone else", false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		entry := &wire.Entry{Name: "a.env", TransferID: "t1"}
+		dataPath, statePath := writePartial(t, dir, entry, "0123456789abcdef", "0123456789abcdef")
+		tt.tamper(t, dataPath, statePath)
+
+		part, err := openPartial(dir, tt.host, entry, testChunkSize, true)
+		if tt.wantErr {
+			if err == nil {
+				part.Close()
+				t.Errorf("%s: opened a partial with a broken state file", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if part.Chunks != 0 || part.Offset != 0 || part.Chain != nil {
+			t.Errorf("%s: resumed from chunk %d", tt.name, part.Chunks)
+		}
+		part.Close()
+	}
+}
+
+func editState(t *testing.T, statePath string, edit func(*partialState)) {
+	t.Helper()
+
+	var state partialState
+	if err := json.Unmarshal([]byte(readFile(t, statePath)), &state); err != nil {
+		t.Fatal(err)
+	}
+	edit(&state)
+	raw, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, statePath, string(raw))
+}
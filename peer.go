@@ -1,14 +1,14 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
-	"os/exec"
 
 	"github.com/Noah-Wilderom/secretshare/auth"
 
@@ -23,17 +23,28 @@ import (
 )
 
 type Peer struct {
-	port       int
-	randomness io.Reader
+	port         int
+	identityPath string
+	known        *auth.KnownPeers
+	code         *pairingCode
+	advertised   io.Closer
 }
 
-func NewPeer(port int, r io.Reader) *Peer {
+// NewPeer makes a peer. With a pairing code, a host is advertised on the
+// local network under it and a client looks for the host there.
+func NewPeer(port int, identityPath string, known *auth.KnownPeers, code *pairingCode) *Peer {
 	return &Peer{
-		port:       port,
-		randomness: r,
+		port:         port,
+		identityPath: identityPath,
+		known:        known,
+		code:         code,
 	}
 }
 
+// insecureKeySource is only set in builds made for testing, see
+// insecure_seed.go.
+var insecureKeySource func(port int) io.Reader
+
 func getLocalIP() (string, error) {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -51,33 +62,9 @@ func getLocalIP() (string, error) {
 	return "", errors.New("no network interface found")
 }
 
-func copyToClipboard(text string) error {
-	cmd := exec.Command("pbcopy")
-	in, err := cmd.StdinPipe()
-	if err != nil {
-		return err
-	}
-
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-
-	if _, err := in.Write([]byte(text)); err != nil {
-		return err
-	}
-
-	if err := in.Close(); err != nil {
-		return err
-	}
-
-	return cmd.Wait()
-}
-
 func (p *Peer) NewHost() (host.Host, error) {
-	// Creates a new RSA key pair for this host.
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, p.randomness)
+	prvKey, err := p.hostKey()
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
@@ -94,14 +81,39 @@ func (p *Peer) NewHost() (host.Host, error) {
 	)
 }
 
+// hostKey returns the stored identity. Without one, the node gets a new key
+// and so a new address on every run.
+func (p *Peer) hostKey() (crypto.PrivKey, error) {
+	if insecureKeySource != nil {
+		log.Println("Warning: Test build, the node key is derived from the port number and not secret")
+		key, _, err := crypto.GenerateEd25519Key(insecureKeySource(p.port))
+		return key, err
+	}
+
+	if p.identityPath != "" {
+		key, err := loadIdentity(p.identityPath, askIdentityPassphrase)
+		if err == nil {
+			log.Printf("Using identity %s\n", p.identityPath)
+			return key, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load identity: %w", err)
+		}
+		log.Printf("Warning: No identity at %s, the address changes on every run. Run '%s identity create' to keep it.\n", p.identityPath, AppName)
+	}
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	return key, err
+}
+
 func (p *Peer) getPID() protocol.ID {
 	return protocol.ID(
 		fmt.Sprintf("/%s/%s", AppName, AppVersion),
 	)
 }
 
-func (p *Peer) Start(_ context.Context, h host.Host, handshaker *auth.GPGHandshake, filePath string, handler network.StreamHandler) error {
-	h.SetStreamHandler(p.getPID(), makeStreamHandler(handshaker, filePath))
+func (p *Peer) Start(_ context.Context, h host.Host, handler network.StreamHandler) error {
+	h.SetStreamHandler(p.getPID(), handler)
 
 	var port string
 	for _, la := range h.Network().ListenAddresses() {
@@ -123,35 +135,49 @@ func (p *Peer) Start(_ context.Context, h host.Host, handshaker *auth.GPGHandsha
 
 	addr := fmt.Sprintf("/ip4/%s/tcp/%s/p2p/%s", localIP, port, h.ID())
 
-	if err := copyToClipboard(addr); err != nil {
+	share := addr
+	if p.code != nil {
+		p.advertised, err = advertise(h, p.code)
+		if err != nil {
+			return err
+		}
+		share = p.code.String()
+	}
+
+	if err := copyToClipboard(share); err != nil {
 		log.Printf("Warning: Could not copy to clipboard: %v\n", err)
+	} else if p.code != nil {
+		log.Println("Pairing code copied to clipboard!")
 	} else {
 		log.Println("Connection address copied to clipboard!")
 	}
 
 	log.Printf("Share this address: %s\n", addr)
+	if p.code != nil {
+		log.Printf("Or on the local network, this pairing code: %s\n", share)
+	}
 	log.Println("Waiting for incoming connection...")
 
 	return nil
 }
 
-func (p *Peer) Connect(h host.Host, destination string, handshaker *auth.GPGHandshake) (*bufio.ReadWriter, error) {
+func (p *Peer) Connect(h host.Host, destination string, handshaker auth.Handshaker) (network.Stream, *auth.Result, error) {
 	log.Println("This node's multiaddresses:")
 	for _, la := range h.Addrs() {
 		log.Printf(" - %v\n", la)
 	}
 	log.Println()
 
-	maddr, err := multiaddr.NewMultiaddr(destination)
+	info, err := p.resolve(h, destination)
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	info, err := peer.AddrInfoFromP2pAddr(maddr)
-	if err != nil {
-		log.Println(err)
-		return nil, err
+	if p.known != nil {
+		if known, ok := p.known.Lookup(info.ID); ok {
+			log.Printf("Connecting to known peer %s (%s)\n", known.Name, known.Fingerprint)
+		}
 	}
 
 	h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
@@ -159,21 +185,60 @@ func (p *Peer) Connect(h host.Host, destination string, handshaker *auth.GPGHand
 	s, err := h.NewStream(context.Background(), info.ID, p.getPID())
 	if err != nil {
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 	log.Println("Established connection to destination")
 
-	if !handshaker.Handshake(s) {
+	result, err := handshaker.Handshake(s)
+	if err != nil {
 		log.Println("Handshake failed, closing connection")
 		s.Reset()
-		return nil, fmt.Errorf("handshake failed")
+		return nil, nil, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	if result.Cipher == nil {
+		s.Reset()
+		return nil, nil, fmt.Errorf("handshake did not agree on a cipher")
 	}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	log.Printf("Authenticated host: %s\n", result.Peer)
+
+	return s, result, nil
+}
+
+// resolve finds the host behind the destination, a multiaddr or, when the
+// peer has a pairing code, that code.
+func (p *Peer) resolve(h host.Host, destination string) (*peer.AddrInfo, error) {
+	if p.code != nil {
+		log.Printf("Looking for the host of pairing code %d-... on the local network\n", p.code.nameplate)
+		info, err := discover(context.Background(), h, p.code)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Found host %s\n", info.ID)
+		return &info, nil
+	}
 
-	return rw, nil
+	maddr, err := multiaddr.NewMultiaddr(destination)
+	if err != nil {
+		return nil, err
+	}
+	return peer.AddrInfoFromP2pAddr(maddr)
 }
 
-func (p *Peer) Disconnect() {
-	//
+// Disconnect stops serving streams, closes every connection and wipes what
+// the handshaker kept, like the peer keys it imported.
+func (p *Peer) Disconnect(h host.Host, handshaker auth.Handshaker) error {
+	h.RemoveStreamHandler(p.getPID())
+	if p.advertised != nil {
+		p.advertised.Close()
+	}
+	err := h.Close()
+
+	if c, ok := handshaker.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
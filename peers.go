@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+)
+
+// defaultKnownPeersPath is where trusted hosts are remembered unless
+// -known-peers says otherwise.
+func defaultKnownPeersPath() string {
+	return configPath("known_peers")
+}
+
+// peersCommand runs 'secretshare peers', which lists the remembered hosts
+// or forgets some of them.
+func peersCommand(args []string) error {
+	flags := flag.NewFlagSet("peers", flag.ExitOnError)
+	path := flags.String("known-peers", defaultKnownPeersPath(), "File the trusted hosts are remembered in")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s peers [list | forget <FINGERPRINT|PEER_ID|NAME>] [options]\n\n", AppName)
+		fmt.Fprintf(flags.Output(), "Hosts are remembered with the peer ID they were seen at, like ssh's known_hosts.\n\n")
+		flags.PrintDefaults()
+	}
+
+	action := "list"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	// Flags may come after the peer to forget as well.
+	var operands []string
+	for flags.Parse(args); flags.NArg() > 0; flags.Parse(args) {
+		operands = append(operands, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if *path == "" {
+		return errors.New("no default location for known peers, pass -known-peers")
+	}
+
+	known, err := auth.LoadKnownPeers(*path)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		if len(known.Peers()) == 0 {
+			fmt.Printf("No known peers in %s\n", *path)
+			return nil
+		}
+		for _, p := range known.Peers() {
+			fmt.Printf("%s\n  Fingerprint: %s\n  Peer ID:     %s\n  Added:       %s\n", p.Name, p.Fingerprint, p.PeerID, p.Added.Format(time.DateOnly))
+		}
+	case "forget":
+		if len(operands) != 1 {
+			flags.Usage()
+			return errors.New("forget takes one fingerprint, peer ID or name")
+		}
+		removed, err := known.Forget(operands[0])
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return fmt.Errorf("no known peer matches %q", operands[0])
+		}
+		fmt.Printf("Forgot %d peer(s)\n", removed)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Package prompt asks the user questions on the terminal. A host serving
+// several clients at once may have more than one question pending, so
+// questions are asked one at a time and all of them share a single reader
+// on stdin, or whatever Use switched to.
+package prompt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+var (
+	mu  sync.Mutex
+	in            = bufio.NewReader(os.Stdin)
+	out io.Writer = os.Stdout
+)
+
+// Use makes questions go to w and answers come from r, for when stdin or
+// stdout carry data.
+func Use(r io.Reader, w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	in = bufio.NewReader(r)
+	out = w
+}
+
+// Terminal opens the controlling terminal for reading and writing.
+func Terminal() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CON"
+	}
+	return os.OpenFile(name, os.O_RDWR, 0)
+}
+
+// Confirm prints message, which may span several lines, and reads a y/N
+// answer. Anything but an explicit yes counts as no.
+func Confirm(message string) bool {
+	response, err := Ask(message + " (y/N): ")
+	if err != nil {
+		log.Printf("Failed to read user input: %v\n", err)
+		return false
+	}
+
+	response = strings.ToLower(response)
+	return response == "y" || response == "yes"
+}
+
+// Ask prints message and returns the line the user typed, without
+// surrounding white space.
+func Ask(message string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fmt.Fprint(out, message)
+
+	response, err := in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(response), nil
+}
+
+// Password prints message and reads a line from the terminal without
+// echoing it. It always talks to the terminal, whatever Use switched to.
+func Password(message string) ([]byte, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	tty, err := Terminal()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, message)
+	password, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return password, err
+}
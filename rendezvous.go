@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	"github.com/libp2p/zeroconf/v2"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// discoveryTimeout is how long a client looks for the host of a pairing
+// code on the local network.
+const discoveryTimeout = 30 * time.Second
+
+// ignorePeers is the notifee of the host's mdns service, which is only
+// there to advertise.
+type ignorePeers struct{}
+
+func (ignorePeers) HandlePeerFound(peer.AddrInfo) {}
+
+// advertise announces the host on the local network under the rendezvous
+// of the code until the returned service is closed.
+func advertise(h host.Host, code *pairingCode) (io.Closer, error) {
+	service := mdns.NewMdnsService(h, code.rendezvous(), ignorePeers{})
+	if err := service.Start(); err != nil {
+		return nil, fmt.Errorf("failed to advertise on the local network: %w", err)
+	}
+	return service, nil
+}
+
+// discover looks for the host advertised under the rendezvous of the code.
+// It only browses: an mdns service would advertise the client too, and
+// other clients with the same code could take it for the host and burn
+// the host's password attempts on it.
+func discover(ctx context.Context, h host.Host, code *pairingCode) (peer.AddrInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	info, err := findPeer(ctx, h.ID(), code.rendezvous())
+	if errors.Is(err, errNoPeer) {
+		return peer.AddrInfo{}, fmt.Errorf("no host with pairing code %d-... found on the local network within %s", code.nameplate, discoveryTimeout)
+	}
+	return info, err
+}
+
+// nameplateProbe is how long a host listens for another host on its
+// nameplate, and nameplateTries how many nameplates it tries.
+const (
+	nameplateProbe = 2 * time.Second
+	nameplateTries = 5
+)
+
+// claimNameplate moves a new code to a nameplate no other host on the local
+// network is advertised under. Clients take the first host they find, so
+// two hosts on one nameplate would have one's clients spend the other's
+// password attempts.
+func claimNameplate(code *pairingCode) error {
+	for range nameplateTries {
+		ctx, cancel := context.WithTimeout(context.Background(), nameplateProbe)
+		_, err := findPeer(ctx, "", code.rendezvous())
+		cancel()
+		if errors.Is(err, errNoPeer) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if code.nameplate, err = randomNameplate(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("no free nameplate found on the local network after %d tries", nameplateTries)
+}
+
+var errNoPeer = errors.New("no peer found")
+
+// findPeer browses for the rendezvous until a peer other than self turns
+// up. It returns errNoPeer once ctx is done.
+func findPeer(ctx context.Context, self peer.ID, rendezvous string) (peer.AddrInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	browseErr := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		browseErr <- zeroconf.Browse(ctx, rendezvous, mdnsDomain, entries)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		// Browse blocks sending entries until it notices, keep taking them.
+		for {
+			select {
+			case <-entries:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				entries = nil
+				continue
+			}
+			for _, info := range advertisedPeers(entry) {
+				if info.ID != self {
+					return info, nil
+				}
+			}
+		case <-stopped:
+			if err := <-browseErr; err != nil && ctx.Err() == nil {
+				return peer.AddrInfo{}, fmt.Errorf("failed to search the local network: %w", err)
+			}
+			return peer.AddrInfo{}, errNoPeer
+		}
+	}
+}
+
+// mdnsDomain and dnsaddrPrefix match what the mdns package advertises.
+const (
+	mdnsDomain    = "local"
+	dnsaddrPrefix = "dnsaddr="
+)
+
+// advertisedPeers reads the peers out of the TXT records mdns advertises,
+// one "dnsaddr=" multiaddr per address.
+func advertisedPeers(entry *zeroconf.ServiceEntry) []peer.AddrInfo {
+	var addrs []multiaddr.Multiaddr
+	for _, txt := range entry.Text {
+		value, ok := strings.CutPrefix(txt, dnsaddrPrefix)
+		if !ok {
+			continue
+		}
+		addr, err := multiaddr.NewMultiaddr(value)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	infos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil
+	}
+	return infos
+}
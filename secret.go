@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"unicode/utf8"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+// maxSecretSize bounds what is held in memory: secrets the host reads from
+// stdin and files the client prints instead of saving.
+const maxSecretSize = 16 << 20
+
+var errSecretTooLarge = fmt.Errorf("secret is larger than %d bytes", maxSecretSize)
+
+// defaultSecretName is what -stdin and -text secrets are called unless
+// -name says otherwise.
+const defaultSecretName = "secret.txt"
+
+// newSecretPayload shares data straight from memory. Only its ciphertext
+// ever reaches the disk.
+func newSecretPayload(name string, data []byte) *payload {
+	return &payload{
+		name:   name,
+		format: wire.FormatFile,
+		size:   int64(len(data)),
+		data:   data,
+	}
+}
+
+// readSecret reads all of r into memory.
+func readSecret(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSecretSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSecretSize {
+		return nil, errSecretTooLarge
+	}
+	return data, nil
+}
+
+// outputMode says what the client does with the files it receives.
+type outputMode int
+
+const (
+	outputFiles     outputMode = iota // save them to the output directory
+	outputStdout                      // write them to stdout as they are, for piping
+	outputPrint                       // show them on the terminal, text only
+	outputClipboard                   // copy them to the clipboard for a while, text only
+	outputExec                        // run a command with them as its environment, dotenv only
+)
+
+// secretBuffer collects plaintext in memory, refusing to grow past
+// maxSecretSize.
+type secretBuffer struct {
+	data []byte
+}
+
+func (b *secretBuffer) Write(p []byte) (int, error) {
+	if len(b.data)+len(p) > maxSecretSize {
+		return 0, errSecretTooLarge
+	}
+	if len(b.data)+len(p) > cap(b.data) {
+		// Don't leave a copy of the plaintext behind in the old array.
+		grown := make([]byte, len(b.data), max(2*cap(b.data), len(b.data)+len(p)))
+		copy(grown, b.data)
+		clear(b.data)
+		b.data = grown
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// revealEntry decrypts the entry into memory and writes it to stdout or the
+// clipboard, or hands it to a command, once it matches the digest the host
+// signed. The plaintext is never stored.
+func revealEntry(encryptor auth.Encryptor, ciphertext io.Reader, entry *wire.Entry, opts receiveOptions) error {
+	plaintext := &secretBuffer{data: make([]byte, 0, min(entry.Size, maxSecretSize))}
+	defer func() { clear(plaintext.data) }()
+
+	if err := encryptor.Decrypt(plaintext, ciphertext); err != nil {
+		return fmt.Errorf("failed to decrypt file: %w", err)
+	}
+
+	digest, err := readerDigest(bytes.NewReader(plaintext.data))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, entry.Digest) {
+		return fmt.Errorf("%w: decrypted file does not match the digest signed by the host", errIntegrity)
+	}
+
+	switch opts.output {
+	case outputStdout:
+		_, err := os.Stdout.Write(plaintext.data)
+		return err
+	case outputExec:
+		return runWithEnv(opts.command, plaintext.data)
+	}
+
+	// Binary data or escape sequences could wreck the terminal or make it
+	// show something else than what was sent.
+	if !printable(plaintext.data) {
+		return fmt.Errorf("%s is not plain text, use -stdout or save it to a file instead", entry.Name)
+	}
+
+	if opts.output == outputClipboard {
+		return holdInClipboard(entry.Name, plaintext.data, opts.clipboardTimeout)
+	}
+
+	log.Printf("Received %s:\n", entry.Name)
+	fmt.Printf("----- %s -----\n", entry.Name)
+	os.Stdout.Write(plaintext.data)
+	if !bytes.HasSuffix(plaintext.data, []byte("\n")) {
+		fmt.Println()
+	}
+	fmt.Printf("----- end of %s -----\n", entry.Name)
+	return nil
+}
+
+// printable reports whether data is UTF-8 text without control characters
+// other than tabs and line breaks.
+func printable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if r == '\n' || r == '\r' || r == '\t' {
+			continue
+		}
+		if isHiddenRune(r) {
+			return false
+		}
+	}
+	return true
+}
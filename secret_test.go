@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretBufferClearsWhenGrowing(t *testing.T) {
+	b := &secretBuffer{data: make([]byte, 0, 4)}
+	b.Write([]byte("pass"))
+	old := b.data[:4]
+
+	if _, err := b.Write([]byte("word")); err != nil {
+		t.Fatal(err)
+	}
+	if string(b.data) != "password" {
+		t.Fatalf("buffer holds %q", b.data)
+	}
+	if !bytes.Equal(old, make([]byte, 4)) {
+		t.Fatalf("old buffer still holds %q", old)
+	}
+
+	if _, err := b.Write(make([]byte, maxSecretSize)); err != errSecretTooLarge {
+		t.Fatalf("writing past maxSecretSize: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Noah-Wilderom/secretshare/prompt"
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+// promptSelection asks which of the offered entries to download and returns
+// their indexes in offer order. Entries with a reason in skipped can't be
+// picked, and no more than limit of them unless it is 0. A single entry is
+// a plain yes or no question.
+func promptSelection(entries []wire.Entry, outputPaths []string, skipped []string, limit int) []uint64 {
+	if len(entries) == 1 {
+		if promptFileAcceptance(&entries[0]) {
+			return []uint64{0}
+		}
+		return nil
+	}
+
+	var list strings.Builder
+	var total int64
+	fmt.Fprintf(&list, "\nIncoming files:\n")
+	for i, entry := range entries {
+		kind := ""
+		if entry.Format != wire.FormatFile {
+			kind = ", directory"
+		}
+
+		note := ""
+		switch {
+		case skipped[i] != "":
+			note = " - " + skipped[i] + ", skipped"
+		case outputPaths[i] != "" && filepath.Base(outputPaths[i]) != entry.Name:
+			note = " - saved as " + filepath.Base(outputPaths[i])
+		}
+
+		fmt.Fprintf(&list, "  %d) %s (%s%s)%s\n", i+1, entry.Name, formatFileSize(entry.Size), kind, note)
+		total += entry.Size
+	}
+	fmt.Fprintf(&list, "Total: %s\n", formatFileSize(total))
+
+	question, retry := "Download which files? [a]ll, [n]one or numbers like 1,3-4: ", "Download which files? "
+	if limit == 1 {
+		question, retry = "Download which file? Enter its number or [n]one: ", "Download which file? "
+	}
+
+	message := list.String() + question
+	for {
+		response, err := prompt.Ask(message)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed to read user input: %v\n", err)
+			}
+			return nil
+		}
+
+		selection, err := parseSelection(response, skipped)
+		if err == nil && limit > 0 && len(selection) > limit {
+			err = fmt.Errorf("pick at most %d", limit)
+		}
+		if err == nil {
+			return selection
+		}
+
+		message = err.Error() + "\n" + retry
+	}
+}
+
+// parseSelection turns the user's answer into entry indexes. "all" picks
+// every entry that isn't skipped, numbers and ranges are 1-based.
+func parseSelection(response string, skipped []string) ([]uint64, error) {
+	response = strings.ToLower(strings.TrimSpace(response))
+
+	picked := make([]bool, len(skipped))
+	switch response {
+	case "", "n", "no", "none":
+		return nil, nil
+	case "a", "all", "y", "yes":
+		for i, reason := range skipped {
+			picked[i] = reason == ""
+		}
+	default:
+		fields := strings.FieldsFunc(response, func(r rune) bool { return r == ',' || r == ' ' })
+		for _, field := range fields {
+			first, last, isRange := strings.Cut(field, "-")
+			if !isRange {
+				last = first
+			}
+
+			from, err := strconv.Atoi(first)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number or range", field)
+			}
+			to, err := strconv.Atoi(last)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number or range", field)
+			}
+			if from < 1 || to > len(skipped) || from > to {
+				return nil, fmt.Errorf("%q is out of range, pick from 1 to %d", field, len(skipped))
+			}
+
+			for n := from; n <= to; n++ {
+				if skipped[n-1] != "" {
+					return nil, fmt.Errorf("%d can't be downloaded: %s", n, skipped[n-1])
+				}
+				picked[n-1] = true
+			}
+		}
+	}
+
+	var selection []uint64
+	for i, ok := range picked {
+		if ok {
+			selection = append(selection, uint64(i))
+		}
+	}
+	return selection, nil
+}
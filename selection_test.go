@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSelection(t *testing.T) {
+	skipped := []string{"", "", "exists", "", ""}
+	tests := []struct {
+		response string
+		want     []uint64
+		err      string // part of the error, if the response must be refused
+	}{
+		{"", nil, ""},
+		{"  ", nil, ""},
+		{"n", nil, ""},
+		{"None", nil, ""},
+		{"a", []uint64{0, 1, 3, 4}, ""},
+		{" ALL\n", []uint64{0, 1, 3, 4}, ""},
+		{"yes", []uint64{0, 1, 3, 4}, ""},
+		{"1", []uint64{0}, ""},
+		{"5,1", []uint64{0, 4}, ""},
+		{"1 4, 5", []uint64{0, 3, 4}, ""},
+		{"1-2", []uint64{0, 1}, ""},
+		{"4-5,1-2", []uint64{0, 1, 3, 4}, ""},
+		{"4-4", []uint64{3}, ""},
+		{"1,1,1-2,2", []uint64{0, 1}, ""},
+		{",,", nil, ""},
+
+		{"0", nil, "out of range, pick from 1 to 5"},
+		{"6", nil, "out of range"},
+		{"4-6", nil, "out of range"},
+		{"2-1", nil, "out of range"},
+		{"-1", nil, "not a number or range"},
+		{"1-", nil, "not a number or range"},
+		{"1-2-3", nil, "not a number or range"},
+		{"one", nil, "not a number or range"},
+		{"1.5", nil, "not a number or range"},
+		{"3", nil, "3 can't be downloaded: exists"},
+		{"2-4", nil, "3 can't be downloaded"},
+		{"1,3", nil, "3 can't be downloaded"},
+	}
+	for _, tt := range tests {
+		got, err := parseSelection(tt.response, skipped)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got %v, %v, want an error about %q", tt.response, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.response, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: picked %v, want %v", tt.response, got, tt.want)
+		}
+	}
+}
+
+func TestParseSelectionAllSkipped(t *testing.T) {
+	got, err := parseSelection("all", []string{"exists", "not text"})
+	if err != nil || len(got) != 0 {
+		t.Fatalf("got %v, %v, want nothing picked", got, err)
+	}
+}
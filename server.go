@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/Noah-Wilderom/secretshare/auth"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -12,45 +15,91 @@ type Server struct {
 	peer        *Peer
 	host        host.Host
 	destination string
-	filePath    string
-	handshaker  *auth.GPGHandshake
+	send        sendOptions
+	receive     receiveOptions
+	handshaker  auth.Handshaker
 }
 
-func NewServer(peer *Peer, destination string, filePath string, handshaker *auth.GPGHandshake) *Server {
+func NewServer(peer *Peer, destination string, send sendOptions, receive receiveOptions, handshaker auth.Handshaker) (*Server, error) {
 	peerHost, err := peer.NewHost()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return &Server{
 		peer:        peer,
 		host:        peerHost,
 		destination: destination,
-		filePath:    filePath,
+		send:        send,
+		receive:     receive,
 		handshaker:  handshaker,
-	}
+	}, nil
 }
 
 func (s *Server) Start(ctx context.Context) error {
-	if s.destination == "" {
-		err := s.peer.Start(ctx, s.host, s.handshaker, s.filePath, nil)
-		if err != nil {
-			return err
+	defer func() {
+		if err := s.peer.Disconnect(s.host, s.handshaker); err != nil {
+			log.Printf("Warning: Failed to disconnect cleanly: %v\n", err)
 		}
-	} else {
-		rw, err := s.peer.Connect(s.host, s.destination, s.handshaker)
+	}()
+
+	if s.destination != "" {
+		stream, result, err := s.peer.Connect(s.host, s.destination, s.handshaker)
 		if err != nil {
 			return err
 		}
 
-		if err := receiveFile(rw); err != nil {
+		if err := receiveFiles(stream, result, s.receive); err != nil {
 			return err
 		}
 
 		log.Println("File transfer completed, closing connection...")
-		s.host.Close()
 		return nil
 	}
 
-	select {}
+	transfers, err := newTransfers()
+	if err != nil {
+		return err
+	}
+	defer transfers.Close()
+
+	limits := newDownloadLimits(s.send.maxDownloads, s.send.expire)
+	sd := newShutdown()
+
+	handler := makeStreamHandler(s.handshaker, s.send, transfers, limits, sd)
+	if err := s.peer.Start(ctx, s.host, handler); err != nil {
+		return err
+	}
+
+	select {
+	case <-limits.Done():
+		log.Printf("Stopped sharing, %v. Shutting down...\n", limits.Err())
+	case <-ctx.Done():
+		log.Println("Shutting down, press Ctrl+C again to quit right away...")
+		limits.end(errShuttingDown)
+
+		select {
+		case <-limits.Done():
+		case <-time.After(shutdownGrace):
+			log.Println("Downloads are still in progress, stopping them")
+		}
+	}
+
+	if !sd.stopStreams(shutdownTimeout) {
+		log.Println("Warning: Some connections did not close in time")
+	}
+
+	if !s.send.shred || !errors.Is(limits.Err(), errOfferExpired) {
+		return nil
+	}
+
+	var errs []error
+	for _, filePath := range s.send.filePaths {
+		if err := shredFile(filePath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shred %s: %w", filePath, err))
+			continue
+		}
+		log.Printf("Shredded %s\n", filePath)
+	}
+	return errors.Join(errs...)
 }
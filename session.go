@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+	"github.com/Noah-Wilderom/secretshare/wire"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// session is a single authenticated client connection on the host. All
+// state that depends on who is on the other end lives here, one per stream,
+// so clients that connect at the same time never see each other's keys.
+type session struct {
+	stream network.Stream
+	codec  *wire.Codec
+	client *auth.Result
+}
+
+func newSession(s network.Stream, client *auth.Result) *session {
+	return &session{
+		stream: s,
+		codec:  wire.NewCodec(s),
+		client: client,
+	}
+}
+
+// logf logs a message tagged with the client it concerns, which keeps the
+// output readable when several transfers run at once.
+func (ss *session) logf(format string, args ...any) {
+	log.Printf("[%s] %s", ss.client.Peer.Name, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+	"github.com/Noah-Wilderom/secretshare/wire"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+// keyHandshake stands in for a real handshake: the host makes up a key for
+// every stream and hands it to the client in the clear. That is enough to
+// give every session keys of its own without GPG. Like with a password, the
+// keys die with the stream, unless the host is given a key to hand out to
+// every client, which makes transfers resumable like a GPG key does.
+type keyHandshake struct {
+	isHost bool
+	key    []byte
+}
+
+func (h keyHandshake) Handshake(s network.Stream) (*auth.Result, error) {
+	key := make([]byte, 32)
+	if h.isHost {
+		if h.key != nil {
+			copy(key, h.key)
+		} else {
+			rand.Read(key)
+		}
+		if _, err := s.Write(key); err != nil {
+			return nil, err
+		}
+	} else if _, err := io.ReadFull(s, key); err != nil {
+		return nil, err
+	}
+
+	return &auth.Result{
+		Peer:         auth.Identity{Name: s.Conn().RemotePeer().String(), PeerID: s.Conn().RemotePeer()},
+		RecipientKey: hex.EncodeToString(key[:8]),
+		Cipher:       keyCipher(key),
+		SessionOnly:  h.key == nil,
+	}, nil
+}
+
+// keyCipher seals a whole payload with AES-GCM and signs with HMAC-SHA256.
+type keyCipher []byte
+
+func (k keyCipher) aead() cipher.AEAD {
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func (k keyCipher) Encrypt(dst io.Writer, src io.Reader) error {
+	plaintext, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, k.aead().NonceSize())
+	rand.Read(nonce)
+	_, err = dst.Write(k.aead().Seal(nonce, nonce, plaintext, nil))
+	return err
+}
+
+func (k keyCipher) Decrypt(dst io.Writer, src io.Reader) error {
+	ciphertext, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	size := k.aead().NonceSize()
+	if len(ciphertext) < size {
+		return errors.New("ciphertext too short")
+	}
+	plaintext, err := k.aead().Open(nil, ciphertext[:size], ciphertext[size:], nil)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(plaintext)
+	return err
+}
+
+func (k keyCipher) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (k keyCipher) Verify(data []byte, signature []byte) error {
+	expected, _ := k.Sign(data)
+	if !hmac.Equal(signature, expected) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// download fetches the first entry the host offers as ciphertext, speaking the
+// protocol directly so the test sees what went over the stream. Once the
+// offer is in, it waits for ready, so every client holds a session at the
+// same time.
+func download(ctx context.Context, client host.Host, hostPeer host.Host, offered func(), ready <-chan struct{}) (*auth.Result, []byte, error) {
+	defer offered()
+
+	s, err := client.NewStream(ctx, hostPeer.ID(), (&Peer{}).getPID())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.Close()
+
+	result, err := keyHandshake{}.Handshake(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	codec := wire.NewCodec(s)
+	offer, err := wire.Expect[*wire.Offer](codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := verifyOffer(offer, result.Cipher); err != nil {
+		return nil, nil, err
+	}
+
+	offered()
+	<-ready
+
+	if err := codec.WriteMessage(&wire.Select{Entries: []uint64{0}}); err != nil {
+		return nil, nil, err
+	}
+	if err := codec.WriteMessage(&wire.Accept{Entry: 0}); err != nil {
+		return nil, nil, err
+	}
+
+	// mocknet streams are unbuffered pipes, so a write blocks until the
+	// other side reads. Reading on its own goroutine keeps the host from
+	// waiting on a chunk while we wait on an Ack.
+	messages := make(chan wire.Message)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			m, err := codec.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- m:
+			case <-ctx.Done():
+				return
+			}
+			if _, done := m.(*wire.Done); done {
+				return
+			}
+		}
+	}()
+
+	var ciphertext bytes.Buffer
+	var chain []byte
+	for {
+		var m wire.Message
+		select {
+		case m = <-messages:
+		case err := <-readErr:
+			return nil, nil, err
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+
+		switch m := m.(type) {
+		case *wire.Chunk:
+			ciphertext.Write(m.Data)
+			chain = wire.Chain(chain, wire.ChunkDigest(m.Data))
+			if err := codec.WriteMessage(&wire.Ack{Index: m.Index, Chain: chain}); err != nil {
+				return nil, nil, err
+			}
+		case *wire.Done:
+			return result, ciphertext.Bytes(), nil
+		case *wire.Error:
+			return nil, nil, m
+		default:
+			return nil, nil, wire.ErrUnexpectedMessage
+		}
+	}
+}
+
+// testNetwork returns n connected peers on a mocknet.
+func testNetwork(t *testing.T, n int) []host.Host {
+	t.Helper()
+
+	mn := mocknet.New()
+	t.Cleanup(func() { mn.Close() })
+
+	var peers []host.Host
+	for range n {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers = append(peers, h)
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+// testFile writes size random bytes to a new file named name.
+func testFile(t *testing.T, name string, size int) (string, []byte) {
+	t.Helper()
+
+	content := make([]byte, size)
+	rand.Read(content)
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filePath, content
+}
+
+// serve shares filePaths from hostPeer.
+func serve(t *testing.T, hostPeer host.Host, handshaker auth.Handshaker, filePaths ...string) *transfers {
+	t.Helper()
+
+	transfers, err := newTransfers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transfers.Close() })
+
+	send := sendOptions{filePaths: filePaths}
+	handler := makeStreamHandler(handshaker, send, transfers, newDownloadLimits(0, 0), newShutdown())
+	hostPeer.SetStreamHandler((&Peer{}).getPID(), handler)
+	return transfers
+}
+
+// spooled counts the spool files the host holds.
+func spooled(t *testing.T, transfers *transfers) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(transfers.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestConcurrentClientsGetOnlyTheirOwnCiphertext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	peers := testNetwork(t, 3)
+	hostPeer, clients := peers[0], peers[1:]
+
+	// A few chunks, so both transfers interleave.
+	filePath, content := testFile(t, "secret.bin", 3*wire.ChunkSize+123)
+	serve(t, hostPeer, keyHandshake{isHost: true}, filePath)
+
+	var offers sync.WaitGroup
+	offers.Add(len(clients))
+	ready := make(chan struct{})
+	go func() {
+		offers.Wait()
+		close(ready)
+	}()
+
+	results := make([]*auth.Result, len(clients))
+	ciphertexts := make([][]byte, len(clients))
+	errs := make([]error, len(clients))
+
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], ciphertexts[i], errs[i] = download(ctx, client, hostPeer, sync.OnceFunc(offers.Done), ready)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+	}
+
+	if results[0].RecipientKey == results[1].RecipientKey {
+		t.Fatalf("both clients got recipient key %s", results[0].RecipientKey)
+	}
+	if bytes.Equal(ciphertexts[0], ciphertexts[1]) {
+		t.Fatal("both clients got the same ciphertext")
+	}
+
+	for i := range clients {
+		var plaintext bytes.Buffer
+		if err := results[i].Cipher.Decrypt(&plaintext, bytes.NewReader(ciphertexts[i])); err != nil {
+			t.Fatalf("client %d can't decrypt its own download: %v", i, err)
+		}
+		if !bytes.Equal(plaintext.Bytes(), content) {
+			t.Fatalf("client %d decrypted something else than the shared file", i)
+		}
+
+		other := results[1-i].Cipher
+		if err := other.Decrypt(io.Discard, bytes.NewReader(ciphertexts[i])); err == nil {
+			t.Fatalf("client %d's download decrypts with client %d's keys", i, 1-i)
+		}
+	}
+}
+
+func TestSessionOnlyTransfersAreDropped(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	peers := testNetwork(t, 2)
+	hostPeer, client := peers[0], peers[1]
+
+	first, _ := testFile(t, "first.bin", 10)
+	second, _ := testFile(t, "second.bin", 3*wire.ChunkSize)
+	transfers := serve(t, hostPeer, keyHandshake{isHost: true}, first, second)
+
+	s, err := client.NewStream(ctx, hostPeer.ID(), (&Peer{}).getPID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := (keyHandshake{}).Handshake(s); err != nil {
+		t.Fatal(err)
+	}
+
+	codec := wire.NewCodec(s)
+	if _, err := wire.Expect[*wire.Offer](codec); err != nil {
+		t.Fatal(err)
+	}
+	if n := spooled(t, transfers); n != 0 {
+		t.Fatalf("host spools %d entries before the client selected any", n)
+	}
+
+	codec.WriteMessage(&wire.Select{Entries: []uint64{1}})
+	codec.WriteMessage(&wire.Accept{Entry: 1})
+	if _, err := wire.Expect[*wire.Chunk](codec); err != nil {
+		t.Fatal(err)
+	}
+	if n := spooled(t, transfers); n != 1 {
+		t.Fatalf("host spools %d entries for one selected entry", n)
+	}
+
+	// Nobody can resume this transfer, so it goes when the stream does.
+	s.Reset()
+	for spooled(t, transfers) != 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("host kept the spool of an interrupted session")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// readWriter pairs the two halves of a stream the test wraps separately.
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// queuedWriter hands writes to a goroutine, so a client never blocks on the
+// host reading an Ack while the host blocks on it reading the next chunk.
+type queuedWriter struct {
+	queue chan []byte
+}
+
+func newQueuedWriter(w io.Writer) *queuedWriter {
+	q := &queuedWriter{queue: make(chan []byte, 256)}
+	go func() {
+		for b := range q.queue {
+			w.Write(b)
+		}
+	}()
+	return q
+}
+
+func (q *queuedWriter) Write(p []byte) (int, error) {
+	q.queue <- bytes.Clone(p)
+	return len(p), nil
+}
+
+func (q *queuedWriter) Close() {
+	close(q.queue)
+}
+
+var errCut = errors.New("connection cut")
+
+// cutReader fails like a dropped connection once n bytes were read.
+type cutReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *cutReader) Read(p []byte) (int, error) {
+	if c.n <= 0 {
+		return 0, errCut
+	}
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.r.Read(p)
+	c.n -= n
+	return n, err
+}
+
+func TestInterruptedTransferResumes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	peers := testNetwork(t, 2)
+	hostPeer, client := peers[0], peers[1]
+
+	filePath, content := testFile(t, "secret.bin", 5*wire.ChunkSize+7)
+	transfers := serve(t, hostPeer, keyHandshake{isHost: true, key: bytes.Repeat([]byte{7}, 32)}, filePath)
+
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "secret.bin")
+	opts := receiveOptions{dir: dir, resume: true, output: outputFiles}
+
+	connect := func(wrap func(io.Reader) io.Reader) (network.Stream, *auth.Result, *wire.Codec, *wire.Offer) {
+		t.Helper()
+
+		s, err := client.NewStream(ctx, hostPeer.ID(), (&Peer{}).getPID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := (keyHandshake{}).Handshake(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := newQueuedWriter(s)
+		t.Cleanup(out.Close)
+		codec := wire.NewCodec(readWriter{wrap(s), out})
+
+		offer, err := wire.Expect[*wire.Offer](codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := codec.WriteMessage(&wire.Select{Entries: []uint64{0}}); err != nil {
+			t.Fatal(err)
+		}
+		return s, result, codec, offer
+	}
+
+	// The first connection drops two and a half chunks in.
+	s, result, codec, offer := connect(func(r io.Reader) io.Reader {
+		return &cutReader{r: r, n: 5 * wire.ChunkSize / 2}
+	})
+	err := receiveEntry(codec, s, result, offer, 0, outputPath, opts)
+	if !errors.Is(err, errCut) {
+		t.Fatalf("first download: %v, want %v", err, errCut)
+	}
+	s.Reset()
+
+	part, err := openPartial(dir, hostPeer.ID().String(), &offer.Entries[0], offer.ChunkSize, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Chunks != 2 {
+		t.Fatalf("partial download holds %d chunks, want 2", part.Chunks)
+	}
+	part.Close()
+
+	// The second one sends only what is missing. Decoding a copy of what
+	// arrives shows which chunks the host sent.
+	pr, pw := io.Pipe()
+	var sent []uint64
+	decoded := make(chan struct{})
+	go func() {
+		defer close(decoded)
+		seen := wire.NewCodec(readWriter{pr, io.Discard})
+		for {
+			m, err := seen.ReadMessage()
+			if err != nil {
+				return
+			}
+			if chunk, ok := m.(*wire.Chunk); ok {
+				sent = append(sent, chunk.Index)
+			}
+		}
+	}()
+
+	s, result, codec, resumed := connect(func(r io.Reader) io.Reader {
+		return io.TeeReader(r, pw)
+	})
+	defer s.Close()
+	if resumed.Entries[0].TransferID != offer.Entries[0].TransferID {
+		t.Fatal("host offered the interrupted file under a new transfer ID")
+	}
+	if err := receiveEntry(codec, s, result, resumed, 0, outputPath, opts); err != nil {
+		t.Fatalf("resumed download: %v", err)
+	}
+	pw.Close()
+	<-decoded
+
+	if len(sent) == 0 || sent[0] != 2 {
+		t.Fatalf("host resumed with chunks %v, want them to start at 2", sent)
+	}
+	if got := readFile(t, outputPath); got != string(content) {
+		t.Fatal("resumed download differs from the shared file")
+	}
+
+	for spooled(t, transfers) != 0 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("host kept the spool of a finished transfer")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
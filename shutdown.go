@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// shutdownGrace is how long downloads in progress may take to finish
+	// once the host is asked to stop.
+	shutdownGrace = 10 * time.Second
+	// shutdownTimeout is how long streams get to tell their client the host
+	// is going away.
+	shutdownTimeout = 2 * time.Second
+)
+
+// shutdown lets the host stop serving without cutting streams off.
+type shutdown struct {
+	ctx  context.Context // canceled once streams have to stop
+	stop context.CancelFunc
+
+	mu      sync.Mutex
+	closing bool
+	streams sync.WaitGroup
+}
+
+func newShutdown() *shutdown {
+	ctx, stop := context.WithCancel(context.Background())
+	return &shutdown{ctx: ctx, stop: stop}
+}
+
+// track registers a stream that is being served. It returns false once the
+// host is shutting down, untrack must be called otherwise.
+func (sd *shutdown) track() bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.closing {
+		return false
+	}
+	sd.streams.Add(1)
+	return true
+}
+
+func (sd *shutdown) untrack() {
+	sd.streams.Done()
+}
+
+// stopStreams makes every stream still served stop at the next message it
+// waits for, and waits up to timeout for them to finish.
+func (sd *shutdown) stopStreams(timeout time.Duration) bool {
+	sd.mu.Lock()
+	sd.closing = true
+	sd.mu.Unlock()
+
+	sd.stop()
+
+	done := make(chan struct{})
+	go func() {
+		sd.streams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
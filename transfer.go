@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+	"github.com/Noah-Wilderom/secretshare/wire"
+)
+
+// spool holds the ciphertext of one transfer on disk. Encryption runs in the
+// background, independent of any stream, so a client that drops and
+// reconnects is served the exact same bytes it was receiving before. It
+// only starts once the client selected the transfer.
+type spool struct {
+	id      string
+	key     string
+	version string // of the payload encrypted into it
+	file    *os.File
+	start   func()
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64
+	done bool
+	err  error
+}
+
+func (sp *spool) Write(p []byte) (int, error) {
+	n, err := sp.file.Write(p)
+
+	sp.mu.Lock()
+	sp.size += int64(n)
+	sp.mu.Unlock()
+	sp.cond.Broadcast()
+
+	return n, err
+}
+
+func (sp *spool) finish(err error) {
+	sp.mu.Lock()
+	sp.done = true
+	sp.err = err
+	sp.mu.Unlock()
+	sp.cond.Broadcast()
+}
+
+// readChunk returns chunk index, waiting for the encryption to produce it.
+// It returns io.EOF once index is past the end of the finished ciphertext.
+func (sp *spool) readChunk(index uint64) ([]byte, error) {
+	offset := int64(index) * wire.ChunkSize
+
+	sp.mu.Lock()
+	for !sp.done && sp.size < offset+wire.ChunkSize {
+		sp.cond.Wait()
+	}
+	size, err := sp.size, sp.err
+	sp.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if offset >= size {
+		return nil, io.EOF
+	}
+
+	data := make([]byte, min(wire.ChunkSize, size-offset))
+	if _, err := sp.file.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("failed to read spooled chunk %d: %w", index, err)
+	}
+
+	return data, nil
+}
+
+// chainAt recomputes the running digest over the first n chunks.
+func (sp *spool) chainAt(n uint64) ([]byte, error) {
+	var chain []byte
+	for i := uint64(0); i < n; i++ {
+		data, err := sp.readChunk(i)
+		if err == io.EOF {
+			return nil, fmt.Errorf("transfer only has %d chunks", i)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = wire.Chain(chain, wire.ChunkDigest(data))
+	}
+
+	return chain, nil
+}
+
+func (sp *spool) failed() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.err != nil
+}
+
+// serves reports whether the spool can still be sent for this version of
+// its payload.
+func (sp *spool) serves(src *payload) bool {
+	return sp.version == src.version && !sp.failed()
+}
+
+// transfers keeps one spool per file and recipient for as long as the host
+// runs, so reconnecting clients get the same transfer ID back. Once a file
+// changes, its spools are replaced. It also keeps the digests offered for
+// each file.
+type transfers struct {
+	dir     string
+	mu      sync.Mutex
+	active  map[string]*spool
+	digests digestCache
+}
+
+func newTransfers() (*transfers, error) {
+	dir, err := os.MkdirTemp("", "secretshare-spool-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	return &transfers{
+		dir:    dir,
+		active: make(map[string]*spool),
+	}, nil
+}
+
+func newTransferID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func transferKey(src *payload, client *auth.Result) string {
+	return client.RecipientKey + "\x00" + src.format + "\x00" + src.path + "\x00" + src.name
+}
+
+// transferID returns the ID to offer src to the client under: that of the
+// transfer it can resume, or a fresh one. Nothing is set up until open.
+func (t *transfers) transferID(src *payload, client *auth.Result) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if sp, ok := t.active[transferKey(src, client)]; ok && sp.serves(src) {
+		return sp.id, nil
+	}
+
+	id, err := newTransferID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate transfer ID: %w", err)
+	}
+	return id, nil
+}
+
+// open returns the transfer of src to the client, setting up a new one
+// under id if there is no usable one yet. A spool of an older version of
+// src is removed. Call start on the spool before reading it.
+func (t *transfers) open(src *payload, client *auth.Result, id string) (*spool, error) {
+	key := transferKey(src, client)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if sp, ok := t.active[key]; ok {
+		if sp.serves(src) {
+			return sp, nil
+		}
+		t.remove(sp)
+	}
+
+	file, err := os.OpenFile(filepath.Join(t.dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+
+	sp := &spool{id: id, key: key, version: src.version, file: file}
+	sp.cond = sync.NewCond(&sp.mu)
+	t.active[key] = sp
+
+	sp.start = sync.OnceFunc(func() {
+		go func() {
+			err := encryptFile(client.Cipher, sp, src)
+			if err != nil {
+				log.Printf("Encryption of transfer %s failed: %v\n", id, err)
+			}
+			sp.finish(err)
+		}()
+	})
+
+	return sp, nil
+}
+
+func encryptFile(encryptor auth.Encryptor, dst io.Writer, src *payload) error {
+	plaintext, err := src.open()
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer plaintext.Close()
+
+	return encryptor.Encrypt(dst, plaintext)
+}
+
+// finish drops a transfer once the client has acknowledged every chunk.
+func (t *transfers) finish(sp *spool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.active[sp.key] == sp {
+		t.remove(sp)
+	}
+}
+
+// drop removes every transfer to the client. A client whose transfers
+// can't be resumed gets dropped once its session ends.
+func (t *transfers) drop(client *auth.Result) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prefix := client.RecipientKey + "\x00"
+	for key, sp := range t.active {
+		if strings.HasPrefix(key, prefix) {
+			t.remove(sp)
+		}
+	}
+}
+
+func (t *transfers) remove(sp *spool) {
+	delete(t.active, sp.key)
+	sp.file.Close()
+	os.Remove(sp.file.Name())
+}
+
+func (t *transfers) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sp := range t.active {
+		t.remove(sp)
+	}
+	return os.RemoveAll(t.dir)
+}
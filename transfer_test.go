@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Noah-Wilderom/secretshare/auth"
+)
+
+func TestTransfersReplaceOldVersions(t *testing.T) {
+	transfers, err := newTransfers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transfers.Close()
+
+	client := &auth.Result{RecipientKey: "alice", Cipher: keyCipher(make([]byte, 32))}
+	filePath, _ := testFile(t, "a.env", 10)
+
+	open := func() *spool {
+		t.Helper()
+		src, err := newPayload(filePath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := transfers.transferID(src, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sp, err := transfers.open(src, client, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sp
+	}
+
+	first := open()
+	if again := open(); again != first {
+		t.Fatal("unchanged file got a new transfer")
+	}
+
+	writeFile(t, filePath, "changed!")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	second := open()
+	if second == first || second.id == first.id {
+		t.Fatal("changed file kept its old transfer")
+	}
+	if n := spooled(t, transfers); n != 1 {
+		t.Fatalf("host spools %d versions of one file", n)
+	}
+}
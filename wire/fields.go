@@ -0,0 +1,82 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errTruncated = errors.New("truncated field")
+
+// encoder appends tagged fields to a payload.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) bytes(tag uint8, v []byte) {
+	e.buf = append(e.buf, tag)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(tag uint8, v string) {
+	e.bytes(tag, []byte(v))
+}
+
+func (e *encoder) uint(tag uint8, v uint64) {
+	e.bytes(tag, binary.AppendUvarint(nil, v))
+}
+
+func (e *encoder) int(tag uint8, v int64) {
+	e.bytes(tag, binary.AppendVarint(nil, v))
+}
+
+// decoder walks the tagged fields of a payload.
+type decoder []byte
+
+func (d decoder) each(fn func(tag uint8, v value) error) error {
+	for len(d) > 0 {
+		tag := d[0]
+		d = d[1:]
+
+		n, size := binary.Uvarint(d)
+		if size <= 0 || n > uint64(len(d)-size) {
+			return fmt.Errorf("%w: tag %d", errTruncated, tag)
+		}
+		d = d[size:]
+
+		if err := fn(tag, value(d[:n])); err != nil {
+			return fmt.Errorf("tag %d: %w", tag, err)
+		}
+		d = d[n:]
+	}
+
+	return nil
+}
+
+// value is the raw content of a single field.
+type value []byte
+
+func (v value) bytes() []byte {
+	return append([]byte(nil), v...)
+}
+
+func (v value) string() string {
+	return string(v)
+}
+
+func (v value) uint() (uint64, error) {
+	n, size := binary.Uvarint(v)
+	if size <= 0 || size != len(v) {
+		return 0, errors.New("invalid uvarint")
+	}
+	return n, nil
+}
+
+func (v value) int() (int64, error) {
+	n, size := binary.Varint(v)
+	if size <= 0 || size != len(v) {
+		return 0, errors.New("invalid varint")
+	}
+	return n, nil
+}
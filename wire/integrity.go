@@ -0,0 +1,19 @@
+package wire
+
+import "crypto/sha256"
+
+// ChunkDigest returns the SHA-256 digest carried alongside a chunk.
+func ChunkDigest(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Chain folds a chunk digest into the running digest of every chunk before
+// it. A single chain value vouches for a whole prefix of the transfer, which
+// is what both sides compare when acknowledging or resuming.
+func Chain(prev []byte, digest []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	h.Write(digest)
+	return h.Sum(nil)
+}
@@ -0,0 +1,487 @@
+package wire
+
+import "fmt"
+
+// Type identifies the kind of message carried in a frame.
+type Type uint8
+
+const (
+	TypeOffer Type = iota + 1
+	TypeAccept
+	TypeReject
+	TypeChunk
+	TypeDone
+	TypeError
+	TypeAck
+	TypeHello
+	TypeProof
+	TypeSelect
+	TypePake
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeOffer:
+		return "Offer"
+	case TypeAccept:
+		return "Accept"
+	case TypeReject:
+		return "Reject"
+	case TypeChunk:
+		return "Chunk"
+	case TypeDone:
+		return "Done"
+	case TypeError:
+		return "Error"
+	case TypeAck:
+		return "Ack"
+	case TypeHello:
+		return "Hello"
+	case TypeProof:
+		return "Proof"
+	case TypeSelect:
+		return "Select"
+	case TypePake:
+		return "Pake"
+	default:
+		return fmt.Sprintf("Type(%d)", uint8(t))
+	}
+}
+
+// Message is implemented by every message that can be sent over a Codec.
+type Message interface {
+	Type() Type
+	marshal(e *encoder)
+	unmarshal(d decoder) error
+}
+
+func newMessage(t Type) (Message, error) {
+	switch t {
+	case TypeOffer:
+		return &Offer{}, nil
+	case TypeAccept:
+		return &Accept{}, nil
+	case TypeReject:
+		return &Reject{}, nil
+	case TypeChunk:
+		return &Chunk{}, nil
+	case TypeDone:
+		return &Done{}, nil
+	case TypeError:
+		return &Error{}, nil
+	case TypeAck:
+		return &Ack{}, nil
+	case TypeHello:
+		return &Hello{}, nil
+	case TypeProof:
+		return &Proof{}, nil
+	case TypeSelect:
+		return &Select{}, nil
+	case TypePake:
+		return &Pake{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownType, uint8(t))
+	}
+}
+
+// Offer is sent by the host to list the files it wants to hand over.
+// ChunkSize applies to all of them and Signature is the host's detached
+// signature over SignedContent.
+type Offer struct {
+	Entries   []Entry
+	ChunkSize uint64
+	Signature []byte
+}
+
+// Entry is a single file in an Offer. TransferID stays the same when a
+// client reconnects to the same host, so an interrupted transfer can be
+// resumed. Digest is the SHA-256 of the plaintext. Format says how the
+// plaintext is to be read, see FormatFile and friends.
+type Entry struct {
+	Name       string
+	Size       int64
+	TransferID string
+	Digest     []byte
+	Format     string
+}
+
+// Payload formats of an Entry.
+const (
+	FormatFile    = ""         // a single file, as is
+	FormatTar     = "tar"      // a directory as a tar archive
+	FormatTarZstd = "tar+zstd" // a directory as a zstd compressed tar archive
+)
+
+func (*Offer) Type() Type { return TypeOffer }
+
+func (m *Offer) marshal(e *encoder) {
+	for i := range m.Entries {
+		var entry encoder
+		m.Entries[i].marshal(&entry)
+		e.bytes(1, entry.buf)
+	}
+	e.uint(2, m.ChunkSize)
+	e.bytes(3, m.Signature)
+}
+
+func (m *Offer) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			var entry Entry
+			err = entry.unmarshal(decoder(v))
+			m.Entries = append(m.Entries, entry)
+		case 2:
+			m.ChunkSize, err = v.uint()
+		case 3:
+			m.Signature = v.bytes()
+		}
+		return err
+	})
+}
+
+func (m *Entry) marshal(e *encoder) {
+	e.string(1, m.Name)
+	e.int(2, m.Size)
+	e.string(3, m.TransferID)
+	e.bytes(4, m.Digest)
+	if m.Format != FormatFile {
+		e.string(5, m.Format)
+	}
+}
+
+func (m *Entry) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			m.Name = v.string()
+		case 2:
+			m.Size, err = v.int()
+		case 3:
+			m.TransferID = v.string()
+		case 4:
+			m.Digest = v.bytes()
+		case 5:
+			m.Format = v.string()
+		}
+		return err
+	})
+}
+
+// SignedContent is the byte string the host signs for an offer. It covers
+// everything the client relies on once the files are decrypted.
+func (m *Offer) SignedContent() []byte {
+	var e encoder
+	e.string(0, "secretshare-offer")
+	for _, entry := range m.Entries {
+		var content encoder
+		content.string(1, entry.Name)
+		content.int(2, entry.Size)
+		content.bytes(4, entry.Digest)
+		content.string(5, entry.Format)
+		e.bytes(1, content.buf)
+	}
+	return e.buf
+}
+
+// Select answers an Offer with the indexes of the entries the client wants,
+// in the order they are to be sent. Declining all of them is a Reject.
+type Select struct {
+	Entries []uint64
+}
+
+func (*Select) Type() Type { return TypeSelect }
+
+func (m *Select) marshal(e *encoder) {
+	for _, index := range m.Entries {
+		e.uint(1, index)
+	}
+}
+
+func (m *Select) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) error {
+		if tag == 1 {
+			index, err := v.uint()
+			if err != nil {
+				return err
+			}
+			m.Entries = append(m.Entries, index)
+		}
+		return nil
+	})
+}
+
+// Accept tells the host to start sending the selected entry at index Entry.
+// A client that already holds the first ResumeFrom chunks asks to continue
+// from there and proves which chunks it has with their Chain value.
+type Accept struct {
+	ResumeFrom uint64
+	Chain      []byte
+	Entry      uint64
+}
+
+func (*Accept) Type() Type { return TypeAccept }
+
+func (m *Accept) marshal(e *encoder) {
+	e.uint(1, m.ResumeFrom)
+	e.bytes(2, m.Chain)
+	e.uint(3, m.Entry)
+}
+
+func (m *Accept) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			m.ResumeFrom, err = v.uint()
+		case 2:
+			m.Chain = v.bytes()
+		case 3:
+			m.Entry, err = v.uint()
+		}
+		return err
+	})
+}
+
+// Reject declines an offer.
+type Reject struct {
+	Reason string
+}
+
+func (*Reject) Type() Type { return TypeReject }
+
+func (m *Reject) marshal(e *encoder) {
+	e.string(1, m.Reason)
+}
+
+func (m *Reject) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) error {
+		if tag == 1 {
+			m.Reason = v.string()
+		}
+		return nil
+	})
+}
+
+// Chunk carries a piece of the encrypted payload together with its
+// position and digest.
+type Chunk struct {
+	Data   []byte
+	Index  uint64
+	Digest []byte
+}
+
+func (*Chunk) Type() Type { return TypeChunk }
+
+func (m *Chunk) marshal(e *encoder) {
+	e.bytes(1, m.Data)
+	e.uint(2, m.Index)
+	e.bytes(3, m.Digest)
+}
+
+func (m *Chunk) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			m.Data = v.bytes()
+		case 2:
+			m.Index, err = v.uint()
+		case 3:
+			m.Digest = v.bytes()
+		}
+		return err
+	})
+}
+
+// Done marks the end of the payload. Chunks and Chain describe the complete
+// transfer so the receiver can check it holds exactly what was sent.
+type Done struct {
+	Chunks uint64
+	Chain  []byte
+}
+
+func (*Done) Type() Type { return TypeDone }
+
+func (m *Done) marshal(e *encoder) {
+	e.uint(1, m.Chunks)
+	e.bytes(2, m.Chain)
+}
+
+func (m *Done) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			m.Chunks, err = v.uint()
+		case 2:
+			m.Chain = v.bytes()
+		}
+		return err
+	})
+}
+
+// Error aborts the exchange. It implements the error interface so it can be
+// handed straight back to callers. Code lets the receiver tell some errors
+// apart without parsing Message.
+type Error struct {
+	Message string
+	Code    ErrorCode
+}
+
+// ErrorCode classifies an Error.
+type ErrorCode uint64
+
+const (
+	CodeUnspecified   ErrorCode = iota
+	CodeExpired                 // the host no longer offers its files
+	CodeShuttingDown            // the host is stopping
+	CodeWrongPassword           // the peer used another password
+)
+
+func (*Error) Type() Type { return TypeError }
+
+func (m *Error) marshal(e *encoder) {
+	e.string(1, m.Message)
+	if m.Code != CodeUnspecified {
+		e.uint(2, uint64(m.Code))
+	}
+}
+
+func (m *Error) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			m.Message = v.string()
+		case 2:
+			var code uint64
+			code, err = v.uint()
+			m.Code = ErrorCode(code)
+		}
+		return err
+	})
+}
+
+func (m *Error) Error() string {
+	return "remote error: " + m.Message
+}
+
+// Ack confirms that the receiver has stored every chunk up to and including
+// Index. Chain is the receiver's running digest at that point.
+type Ack struct {
+	Index uint64
+	Chain []byte
+}
+
+func (*Ack) Type() Type { return TypeAck }
+
+func (m *Ack) marshal(e *encoder) {
+	e.uint(1, m.Index)
+	e.bytes(2, m.Chain)
+}
+
+func (m *Ack) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) (err error) {
+		switch tag {
+		case 1:
+			m.Index, err = v.uint()
+		case 2:
+			m.Chain = v.bytes()
+		}
+		return err
+	})
+}
+
+// Hello opens the handshake. Each side announces its GPG identity and a
+// fresh nonce the other side has to sign.
+//
+// The client also lists the encryptions it supports, with the age
+// recipient to use for age, and the host answers with the one it picked.
+type Hello struct {
+	UserID       string
+	Fingerprint  string
+	PublicKey    []byte
+	Nonce        []byte
+	Encryptions  []string
+	AgeRecipient string
+	Encryption   string
+}
+
+func (*Hello) Type() Type { return TypeHello }
+
+func (m *Hello) marshal(e *encoder) {
+	e.string(1, m.UserID)
+	e.string(2, m.Fingerprint)
+	e.bytes(3, m.PublicKey)
+	e.bytes(4, m.Nonce)
+	for _, encryption := range m.Encryptions {
+		e.string(5, encryption)
+	}
+	if m.AgeRecipient != "" {
+		e.string(6, m.AgeRecipient)
+	}
+	if m.Encryption != "" {
+		e.string(7, m.Encryption)
+	}
+}
+
+func (m *Hello) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) error {
+		switch tag {
+		case 1:
+			m.UserID = v.string()
+		case 2:
+			m.Fingerprint = v.string()
+		case 3:
+			m.PublicKey = v.bytes()
+		case 4:
+			m.Nonce = v.bytes()
+		case 5:
+			m.Encryptions = append(m.Encryptions, v.string())
+		case 6:
+			m.AgeRecipient = v.string()
+		case 7:
+			m.Encryption = v.string()
+		}
+		return nil
+	})
+}
+
+// Proof carries a signature over the handshake challenge, showing that the
+// sender holds the secret key it announced in its Hello.
+type Proof struct {
+	Signature []byte
+}
+
+func (*Proof) Type() Type { return TypeProof }
+
+func (m *Proof) marshal(e *encoder) {
+	e.bytes(1, m.Signature)
+}
+
+func (m *Proof) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) error {
+		if tag == 1 {
+			m.Signature = v.bytes()
+		}
+		return nil
+	})
+}
+
+// Pake carries one side's share of the password authenticated key exchange
+// that replaces Hello when both sides only have a shared password.
+type Pake struct {
+	Share []byte
+}
+
+func (*Pake) Type() Type { return TypePake }
+
+func (m *Pake) marshal(e *encoder) {
+	e.bytes(1, m.Share)
+}
+
+func (m *Pake) unmarshal(d decoder) error {
+	return d.each(func(tag uint8, v value) error {
+		if tag == 1 {
+			m.Share = v.bytes()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,128 @@
+// Package wire implements the framed message protocol spoken between a
+// secretshare host and client.
+//
+// Every message travels as a single frame:
+//
+//	+---------+------+-----------------+---------+
+//	| version | type | length (uint32) | payload |
+//	+---------+------+-----------------+---------+
+//
+// The payload is a sequence of typed fields (tag, uvarint length, value).
+// Decoders skip tags they don't know, so fields can be added to a message
+// without breaking peers that speak the same protocol version.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the protocol version written into every frame.
+const Version = 2
+
+// MaxPayloadSize bounds the payload of a single frame so a misbehaving peer
+// can't make us allocate arbitrary amounts of memory.
+const MaxPayloadSize = 4 << 20
+
+// ChunkSize is how much payload data a sender puts into each Chunk.
+const ChunkSize = 64 << 10
+
+const headerSize = 6
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrFrameTooLarge      = errors.New("frame exceeds maximum payload size")
+	ErrUnknownType        = errors.New("unknown message type")
+	ErrUnexpectedMessage  = errors.New("unexpected message")
+)
+
+// Codec reads and writes framed messages on a stream.
+//
+// It does no read-ahead buffering, so several codecs may be used one after
+// another on the same stream without losing bytes.
+type Codec struct {
+	r io.Reader
+	w io.Writer
+}
+
+func NewCodec(rw io.ReadWriter) *Codec {
+	return &Codec{r: rw, w: rw}
+}
+
+// WriteMessage encodes m and writes it as one frame.
+func (c *Codec) WriteMessage(m Message) error {
+	var e encoder
+	m.marshal(&e)
+
+	if len(e.buf) > MaxPayloadSize {
+		return fmt.Errorf("%w: %s is %d bytes", ErrFrameTooLarge, m.Type(), len(e.buf))
+	}
+
+	frame := make([]byte, headerSize, headerSize+len(e.buf))
+	frame[0] = Version
+	frame[1] = byte(m.Type())
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(e.buf)))
+	frame = append(frame, e.buf...)
+
+	if _, err := c.w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write %s: %w", m.Type(), err)
+	}
+
+	return nil
+}
+
+// ReadMessage reads the next frame and decodes it into its message type.
+func (c *Codec) ReadMessage() (Message, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != Version {
+		return nil, fmt.Errorf("%w: got %d, want %d", ErrUnsupportedVersion, header[0], Version)
+	}
+
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > MaxPayloadSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+
+	m, err := newMessage(Type(header[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read %s payload: %w", m.Type(), err)
+	}
+
+	if err := m.unmarshal(decoder(payload)); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", m.Type(), err)
+	}
+
+	return m, nil
+}
+
+// Expect reads the next message and requires it to be of type T.
+// An Error message from the peer is returned as the error.
+func Expect[T Message](c *Codec) (T, error) {
+	var zero T
+
+	m, err := c.ReadMessage()
+	if err != nil {
+		return zero, err
+	}
+
+	if t, ok := m.(T); ok {
+		return t, nil
+	}
+
+	if e, ok := m.(*Error); ok {
+		return zero, e
+	}
+
+	return zero, fmt.Errorf("%w: got %s, want %s", ErrUnexpectedMessage, m.Type(), zero.Type())
+}
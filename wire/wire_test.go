@@ -0,0 +1,168 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// frame builds a raw frame, to feed the codec what a well behaved peer
+// wouldn't send.
+func frame(version byte, t Type, payload []byte) []byte {
+	b := []byte{version, byte(t), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	messages := []Message{
+		&Offer{
+			Entries: []Entry{
+				{Name: "a.env", Size: 12, TransferID: "t1", Digest: []byte{1, 2}},
+				{Name: "dir", Size: -1, TransferID: "t2", Digest: []byte{3}, Format: FormatTarZstd},
+			},
+			ChunkSize: ChunkSize,
+			Signature: []byte("signature"),
+		},
+		&Select{Entries: []uint64{2, 0, 1}},
+		&Accept{ResumeFrom: 7, Chain: []byte("chain"), Entry: 1},
+		&Reject{Reason: "no thanks"},
+		&Chunk{Data: []byte("data"), Index: 1 << 40, Digest: ChunkDigest([]byte("data"))},
+		&Done{Chunks: 3, Chain: []byte("chain")},
+		&Error{Message: "gone", Code: CodeExpired},
+		&Ack{Index: 2, Chain: []byte("chain")},
+		&Hello{
+			UserID:       "Alice <alice@example.com>",
+			Fingerprint:  "0123456789ABCDEF0123456789ABCDEF01234567",
+			PublicKey:    []byte("key"),
+			Nonce:        []byte("nonce"),
+			Encryptions:  []string{"age", "gpg"},
+			AgeRecipient: "age1xyz",
+			Encryption:   "age",
+		},
+		&Proof{Signature: []byte("signature")},
+		&Pake{Share: []byte("share")},
+	}
+
+	var buf bytes.Buffer
+	codec := NewCodec(&buf)
+	for _, m := range messages {
+		if err := codec.WriteMessage(m); err != nil {
+			t.Fatalf("WriteMessage(%s): %v", m.Type(), err)
+		}
+	}
+
+	for _, want := range messages {
+		got, err := codec.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage(%s): %v", want.Type(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s round trip:\n got %+v\nwant %+v", want.Type(), got, want)
+		}
+	}
+
+	if _, err := codec.ReadMessage(); err != io.EOF {
+		t.Fatalf("ReadMessage after the last frame = %v, want EOF", err)
+	}
+}
+
+func TestUnknownTagsAreSkipped(t *testing.T) {
+	var e encoder
+	e.string(99, "from a newer peer")
+	e.string(1, "reason")
+	e.bytes(200, nil)
+
+	codec := NewCodec(bytes.NewBuffer(frame(Version, TypeReject, e.buf)))
+	m, err := Expect[*Reject](codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Reason != "reason" {
+		t.Fatalf("Reason = %q, want %q", m.Reason, "reason")
+	}
+}
+
+func TestTruncatedField(t *testing.T) {
+	var e encoder
+	e.string(1, "reason")
+	payload := e.buf[:len(e.buf)-1] // length says one byte more than there is
+
+	codec := NewCodec(bytes.NewBuffer(frame(Version, TypeReject, payload)))
+	if _, err := codec.ReadMessage(); !errors.Is(err, errTruncated) {
+		t.Fatalf("ReadMessage = %v, want %v", err, errTruncated)
+	}
+
+	// A bad varint inside a field that is otherwise complete.
+	var bad encoder
+	bad.bytes(1, []byte{0x80})
+	codec = NewCodec(bytes.NewBuffer(frame(Version, TypeAck, bad.buf)))
+	if _, err := codec.ReadMessage(); err == nil {
+		t.Fatal("ReadMessage accepted an invalid uvarint")
+	}
+}
+
+func TestTruncatedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewCodec(&buf).WriteMessage(&Reject{Reason: "reason"}); err != nil {
+		t.Fatal(err)
+	}
+
+	codec := NewCodec(bytes.NewBuffer(buf.Bytes()[:buf.Len()-1]))
+	if _, err := codec.ReadMessage(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadMessage = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestWrongVersion(t *testing.T) {
+	codec := NewCodec(bytes.NewBuffer(frame(Version+1, TypeReject, nil)))
+	if _, err := codec.ReadMessage(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("ReadMessage = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestUnknownType(t *testing.T) {
+	codec := NewCodec(bytes.NewBuffer(frame(Version, 0xff, nil)))
+	if _, err := codec.ReadMessage(); !errors.Is(err, ErrUnknownType) {
+		t.Fatalf("ReadMessage = %v, want %v", err, ErrUnknownType)
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	header := frame(Version, TypeChunk, nil)
+	binary.BigEndian.PutUint32(header[2:], MaxPayloadSize+1)
+
+	codec := NewCodec(bytes.NewBuffer(header))
+	if _, err := codec.ReadMessage(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("ReadMessage = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	var buf bytes.Buffer
+	err := NewCodec(&buf).WriteMessage(&Chunk{Data: make([]byte, MaxPayloadSize)})
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("WriteMessage = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("WriteMessage wrote %d bytes of a frame it refused", buf.Len())
+	}
+}
+
+func TestExpect(t *testing.T) {
+	var buf bytes.Buffer
+	codec := NewCodec(&buf)
+	codec.WriteMessage(&Error{Message: "host shutting down", Code: CodeShuttingDown})
+	codec.WriteMessage(&Done{})
+
+	_, err := Expect[*Proof](codec)
+	var peerErr *Error
+	if !errors.As(err, &peerErr) || peerErr.Code != CodeShuttingDown {
+		t.Fatalf("Expect = %v, want the peer's Error", err)
+	}
+
+	if _, err := Expect[*Proof](codec); !errors.Is(err, ErrUnexpectedMessage) {
+		t.Fatalf("Expect = %v, want %v", err, ErrUnexpectedMessage)
+	}
+}